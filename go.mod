@@ -7,7 +7,6 @@ require (
 	github.com/armon/go-metrics v0.0.0-20190430140413-ec5e00d3c878 // indirect
 	github.com/cenkalti/backoff v2.1.1+incompatible // indirect
 	github.com/dimfeld/httptreemux v5.0.1+incompatible // indirect
-	github.com/drhodes/golorem v0.0.0-20160418191928-ecccc744c2d9 // indirect
 	github.com/efarrer/iothrottler v0.0.1 // indirect
 	github.com/fatih/color v1.7.0 // indirect
 	github.com/fieldkit/app-protocol v0.0.0-20230512235359-6d36389837f4
@@ -44,4 +43,5 @@ require (
 	google.golang.org/protobuf v1.30.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/cheggaaa/pb.v1 v1.0.28 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
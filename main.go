@@ -1,441 +1,260 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/binary"
-	"encoding/hex"
+	"context"
 	"flag"
-	"fmt"
-	"io"
 	"log"
-	"math/rand"
-	"net"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/grandcat/zeroconf"
-
-	"github.com/golang/protobuf/proto"
-
-	pb "github.com/fieldkit/app-protocol"
-	pbatlas "github.com/fieldkit/atlas-protocol"
+	"github.com/conservify/fk-fake-device/simulator"
 )
 
-func PublishAddressOverZeroConf(name string, deviceId string, port int) *zeroconf.Server {
-	serviceType := "_fk._tcp"
-
-	server, err := zeroconf.Register(deviceId, serviceType, "local.", port, nil, nil)
-	if err != nil {
-		panic(err)
-	}
-
-	server.TTL(10)
-
-	log.Printf("Registered ZeroConf: %v %v %v", name, serviceType, deviceId)
-
-	return server
-}
-
 type Options struct {
 	Names         string
+	Profile       string
+	Faults        string
 	NoModules     bool
 	PrimeReadings int
+	Seed          int64
+	ClockStart    string
+	ClockScale    float64
 	Latitude      float64
 	Longitude     float64
+	AdminPort     int
+	BasePort      int
+	Bind          string
+	Manifest      string
+	Reboot        float64
+	FirmwareFail  string
+	Reset         bool
+	UdpGroup      string
+	UdpPort       int
+	UdpInterval   float64
+	UdpTtl        int
+	UdpInterface  string
+	UdpBroadcast  bool
+	UdpLoopback   bool
+	UdpIpv6       bool
+	ZeroConfTtl   int
+	ZeroConfHttps bool
+	ZeroConfIface string
+	Scenario      string
+	ScenarioExit  bool
 }
 
-type StreamState struct {
-	Time    uint64
-	Size    uint64
-	Version uint32
-	Record  uint64
-	File    string
-}
+func main() {
+	o := Options{}
 
-type RecordHeader struct {
-	Size   uint32
-	Record uint64
-}
+	flag.StringVar(&o.Names, "names", "fake0", "")
+	flag.StringVar(&o.Profile, "profile", "", "yaml or json file describing stations")
+	flag.StringVar(&o.Faults, "faults", "", "yaml or json file of fault rules, reloaded on SIGHUP")
+	flag.BoolVar(&o.NoModules, "no-modules", false, "")
+	flag.IntVar(&o.PrimeReadings, "prime-readings", 0, "")
+	flag.Float64Var(&o.Latitude, "latitude", 0, "")
+	flag.Float64Var(&o.Longitude, "longitude", 0, "")
+	flag.Int64Var(&o.Seed, "seed", 0, "seed for all randomness, 0 picks one")
+	flag.StringVar(&o.ClockStart, "clock-start", "", "start the simulated clock at this RFC3339 time")
+	flag.Float64Var(&o.ClockScale, "clock-scale", 1, "simulated seconds per real second, 0 to step to the next timer")
+	flag.IntVar(&o.AdminPort, "admin-port", 0, "serve the admin json api on this port, 0 to disable")
+	flag.IntVar(&o.BasePort, "port", simulator.BasePort, "port of the first station, 0 for ephemeral ports")
+	flag.StringVar(&o.Bind, "bind", "", "address to listen on, all interfaces by default")
+	flag.StringVar(&o.Manifest, "manifest", "", "write the stations and their ports to this json file")
+	flag.Float64Var(&o.Reboot, "reboot-seconds", simulator.DefaultRebootDuration.Seconds(), "how long stations are offline after a firmware upgrade")
+	flag.StringVar(&o.FirmwareFail, "firmware-failure", "", "fail firmware uploads, bad-hash or interrupted")
+	flag.BoolVar(&o.Reset, "reset", false, "forget state saved by previous runs")
+	flag.StringVar(&o.UdpGroup, "udp-group", simulator.DiscoveryGroup, "multicast group for udp discovery")
+	flag.IntVar(&o.UdpPort, "udp-port", simulator.DiscoveryPort, "port for udp discovery")
+	flag.Float64Var(&o.UdpInterval, "udp-interval", simulator.DiscoveryInterval.Seconds(), "seconds between udp announcements")
+	flag.IntVar(&o.UdpTtl, "udp-ttl", 0, "multicast ttl for udp discovery, 0 for the system default")
+	flag.StringVar(&o.UdpInterface, "udp-interface", "", "interface to send udp discovery from")
+	flag.BoolVar(&o.UdpBroadcast, "udp-broadcast", false, "send udp discovery to each subnet's broadcast address instead of the multicast group")
+	flag.BoolVar(&o.UdpLoopback, "udp-loopback", false, "allow loopback and virtual interfaces for udp discovery")
+	flag.BoolVar(&o.UdpIpv6, "udp-ipv6", false, "allow ipv6 addresses for udp discovery")
+	flag.IntVar(&o.ZeroConfTtl, "zeroconf-ttl", simulator.ZeroConfTTL, "ttl of zeroconf records")
+	flag.BoolVar(&o.ZeroConfHttps, "zeroconf-https", false, "also advertise the tls port as "+simulator.ZeroConfHttpsService)
+	flag.StringVar(&o.ZeroConfIface, "zeroconf-interfaces", "", "comma separated interfaces to advertise on, all by default")
+	flag.StringVar(&o.Scenario, "scenario", "", "yaml or json file of timed steps to play against the stations")
+	flag.BoolVar(&o.ScenarioExit, "scenario-exit", false, "exit when the scenario is done, with status 1 if any step failed")
+	flag.Parse()
 
-func (ss *StreamState) Append(body []byte) {
-	file, err := os.OpenFile(ss.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	clock, err := simulator.NewClock(o.ClockStart, o.ClockScale)
 	if err != nil {
-		panic(err)
+		log.Fatalf("Error: %v", err)
 	}
 
-	defer file.Close()
-
-	header := RecordHeader{
-		Size:   uint32(len(body)),
-		Record: ss.Record,
+	options := simulator.Options{
+		Names:           strings.Split(o.Names, ","),
+		NoModules:       o.NoModules,
+		PrimeReadings:   o.PrimeReadings,
+		Seed:            o.Seed,
+		Clock:           clock,
+		Latitude:        float32(o.Latitude),
+		Longitude:       float32(o.Longitude),
+		BasePort:        o.BasePort,
+		Bind:            o.Bind,
+		Directory:       ".",
+		Announce:        true,
+		Reset:           o.Reset,
+		RebootDuration:  time.Duration(o.Reboot * float64(time.Second)),
+		FirmwareFailure: o.FirmwareFail,
 	}
 
-	var record bytes.Buffer
-
-	binary.Write(&record, binary.BigEndian, header)
-
-	file.Write(record.Bytes())
-	file.Write(body)
-
-	ss.Record += 1
-	ss.Time = uint64(time.Now().Unix())
-	ss.Size += uint64(len(body))
-
-	log.Printf("Append reading %v (%v bytes)", ss.Record, ss.Size)
-}
-
-func (ss *StreamState) AppendConfiguration() {
-	record := generateFakeConfiguration()
-	body := proto.NewBuffer(make([]byte, 0))
-	body.EncodeMessage(record)
-	ss.Append(body.Bytes())
-}
-
-func (ss *StreamState) AppendReading() {
-	record := generateFakeReading(uint32(ss.Record))
-	body := proto.NewBuffer(make([]byte, 0))
-	body.EncodeMessage(record)
-	ss.Append(body.Bytes())
-}
-
-func (ss *StreamState) OpenFile() (*os.File, error) {
-	return os.OpenFile(ss.File, os.O_CREATE, 0644)
-}
-
-func (ss *StreamState) PositionOf(record uint64) int64 {
-	file, err := os.OpenFile(ss.File, os.O_CREATE, 0644)
-	if err != nil {
-		panic(err)
+	options.ZeroConf = simulator.ZeroConfOptions{
+		TTL:   uint32(o.ZeroConfTtl),
+		Https: o.ZeroConfHttps,
 	}
 
-	defer file.Close()
-
-	position := int64(0)
-
-	for true {
-		header := RecordHeader{}
-		err := binary.Read(file, binary.BigEndian, &header)
-		if err == io.EOF {
-			break
-		}
-
-		if header.Record == record {
-			log.Printf("Position(%d) = %d", record, position)
-
-			return position
-		}
+	if o.ZeroConfIface != "" {
+		options.ZeroConf.Interfaces = strings.Split(o.ZeroConfIface, ",")
+	}
 
-		_, err = file.Seek(int64(header.Size), 1)
+	if o.Faults != "" {
+		rules, err := simulator.LoadFaultRules(o.Faults)
 		if err != nil {
-			panic(err)
+			log.Fatalf("Error: %v", err)
 		}
 
-		position += int64(header.Size)
+		options.Faults = rules
 	}
 
-	log.Printf("Position(%d) = %d (EOF)", record, position)
+	if o.Profile != "" {
+		profile, err := simulator.LoadProfile(o.Profile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
 
-	return position
-}
+		// Flags given on the command line take precedence over the profile.
+		given := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			given[f.Name] = true
+		})
+		if profile.BasePort != nil && !given["port"] {
+			options.BasePort = *profile.BasePort
+		}
+		if profile.Bind != "" && !given["bind"] {
+			options.Bind = profile.Bind
+		}
+		if err := profile.CheckPorts(options.BasePort); err != nil {
+			log.Fatalf("Error: invalid profile %s: %v", o.Profile, err)
+		}
 
-func (ss *StreamState) Open() {
-	file, err := os.OpenFile(ss.File, os.O_CREATE, 0644)
-	if err != nil {
-		panic(err)
+		options.Profile = profile
 	}
 
-	defer file.Close()
-
-	for true {
-		header := RecordHeader{}
-		err := binary.Read(file, binary.BigEndian, &header)
-		if err == io.EOF {
-			break
-		}
-
-		_, err = file.Seek(int64(header.Size), 1)
+	var scenario *simulator.Scenario
+	if o.Scenario != "" {
+		scenario, err = simulator.LoadScenario(o.Scenario)
 		if err != nil {
-			panic(err)
+			log.Fatalf("Error: %v", err)
 		}
-
-		ss.Record = header.Record + 1
-		ss.Size += uint64(header.Size)
 	}
 
-	log.Printf("Opened %s (#%d) (%d bytes)", ss.File, ss.Record, ss.Size)
-}
-
-type HardwareState struct {
-	Identity      pb.Identity
-	Lora          *pb.LoraSettings
-	Streams       [2]*StreamState
-	Networks      []*pb.NetworkInfo
-	ReadingsReady bool
-	Recording     bool
-	StartedTime   uint64
-}
-
-type FakeModule struct {
-	Position      int
-	SensorType    pbatlas.SensorType
-	Configuration []byte
-}
-
-type FakeDevice struct {
-	Name             string
-	DeviceId         string
-	Port             int
-	ZeroConf         *zeroconf.Server
-	WebServer        *HttpServer
-	State            *HardwareState
-	Latitude         float32
-	Longitude        float32
-	HaveLocation     bool
-	Modules          []*FakeModule
-	ReadingsSchedule *pb.Schedule
-	Firmware         *pb.Firmware
-}
+	// Registered first so that it runs after everything's been closed.
+	status := 0
+	defer func() {
+		if status != 0 {
+			os.Exit(status)
+		}
+	}()
 
-func (fd *FakeDevice) Start(dispatcher *Dispatcher) {
-	ws, err := NewHttpServer(fd, dispatcher)
+	sim, err := simulator.NewSimulator(options)
 	if err != nil {
-		panic(err)
+		log.Fatalf("Error: %v", err)
 	}
 
-	fd.WebServer = ws
+	log.Printf("Seed: %v", sim.Environment.Seed)
 
-	fd.ZeroConf = PublishAddressOverZeroConf(fd.Name, fd.DeviceId, fd.Port)
-}
-
-func (fd *FakeDevice) Close() {
-	log.Printf("%s Close\n", fd.Name)
-	fd.ZeroConf.Shutdown()
-	fd.WebServer.Close()
-}
-
-func (fd *FakeDevice) FakeReadings() {
-	fd.State.Streams[0].Open()
-	fd.State.Streams[1].Open()
+	defer sim.Close()
 
-	fd.State.Streams[1].AppendConfiguration()
-
-	for {
-		fd.State.Streams[0].AppendReading()
-
-		time.Sleep(5 * time.Second)
-	}
-}
-
-func CreateFakeDevicesNamed(names []string, noModules bool, latitude, longitude float32) []*FakeDevice {
-	devices := make([]*FakeDevice, len(names))
-	for i, name := range names {
-		deviceIdHasher := sha1.New()
-		deviceIdHasher.Write([]byte(fmt.Sprintf("station-%s", name)))
-		deviceID := deviceIdHasher.Sum(nil)
-
-		generationHasher := sha1.New()
-		generationHasher.Write([]byte(fmt.Sprintf("station-%s-generation", name)))
-		generation := generationHasher.Sum(nil)
-
-		state := HardwareState{
-			Recording:   false,
-			StartedTime: 0, // uint64(time.Now().Unix() - 300),
-			Lora: &pb.LoraSettings{
-				DeviceEui: deviceID,
-			},
-			Identity: pb.Identity{
-				DeviceId:     deviceID,
-				GenerationId: generation,
-				Device:       name,
-				Name:         name,
-			},
-			Networks: []*pb.NetworkInfo{
-				&pb.NetworkInfo{
-					Ssid:     "Fake",
-					Password: "Network",
-				},
-			},
-			Streams: [2]*StreamState{
-				&StreamState{
-					Time:    0,
-					Size:    0,
-					Version: 0,
-					Record:  0,
-					File:    fmt.Sprintf("%s-data.fkpb", name),
-				},
-				&StreamState{
-					Time:    0,
-					Size:    0,
-					Version: 0,
-					Record:  0,
-					File:    fmt.Sprintf("%s-meta.fkpb", name),
-				},
-			},
-		}
-
-		now := time.Now().UTC()
-
-		stationLatitude := latitude + (rand.Float32() * 2.00) - 1.0
-		stationLongitude := longitude + (rand.Float32() * 2.00) - 1.0
-
-		log.Printf("Location: %v %v", stationLatitude, stationLongitude)
-
-		devices[i] = &FakeDevice{
-			Name:     name,
-			DeviceId: hex.EncodeToString(deviceID),
-			Port:     2380 + i,
-			State:    &state,
-			ReadingsSchedule: &pb.Schedule{
-				Interval: 60,
-				Intervals: []*pb.Interval{
-					&pb.Interval{
-						Start:    0,
-						End:      86400,
-						Interval: 60,
-					},
-				},
-			},
-			Latitude:     stationLatitude,
-			Longitude:    stationLongitude,
-			HaveLocation: true,
-			Firmware: &pb.Firmware{
-				Timestamp: uint64(now.Unix()),
-				Hash:      "hash",
-				Number:    "590",
-				Version:   "1.0.0-main.0-abcdef",
-			},
-			Modules: []*FakeModule{
-				&FakeModule{
-					Position:   0,
-					SensorType: pbatlas.SensorType_SENSOR_PH,
-				},
-				&FakeModule{
-					Position:   1,
-					SensorType: pbatlas.SensorType_SENSOR_EC,
-				},
-				&FakeModule{
-					Position:   2,
-					SensorType: pbatlas.SensorType_SENSOR_TEMP,
-				},
-				&FakeModule{
-					Position:   3,
-					SensorType: pbatlas.SensorType_SENSOR_DO,
-				},
-				&FakeModule{
-					Position:   4,
-					SensorType: pbatlas.SensorType_SENSOR_ORP,
-				},
-			},
+	if o.Manifest != "" {
+		if err := sim.Stations.WriteManifest(o.Manifest); err != nil {
+			log.Fatalf("Error: %v", err)
 		}
-
-		if noModules {
-			devices[i].Modules = make([]*FakeModule, 0)
-		}
-	}
-	return devices
-}
-
-func PublishDnsDiscovery(address string, devices []*FakeDevice) error {
-	addr, err := net.ResolveUDPAddr("udp4", address)
-	if err != nil {
-		return err
-	}
-
-	conn, err := net.DialUDP("udp4", nil, addr)
-	if err != nil {
-		return err
 	}
 
-	log.Printf("Publishing UDP on %v", address)
-
-	messages := make([][]byte, 0)
-	for _, device := range devices {
-		deviceId, err := hex.DecodeString(device.DeviceId)
+	if o.AdminPort > 0 {
+		admin, err := simulator.NewAdminServer(sim.Stations, sim.Environment, options.Bind, o.AdminPort, options.Latitude, options.Longitude)
 		if err != nil {
-			return err
-		}
-		udp := &pb.UdpMessage{
-			DeviceId: deviceId,
-			Status:   pb.UdpStatus_UDP_STATUS_ONLINE,
-			Port:     uint32(device.Port),
+			log.Fatalf("Error: %v", err)
 		}
-		data, err := proto.Marshal(udp)
-		if err != nil {
-			return err
-		}
-		buf := proto.NewBuffer(make([]byte, 0))
-		buf.EncodeRawBytes(data)
-		messages = append(messages, buf.Bytes())
-	}
 
-	for {
-		for _, message := range messages {
-			log.Printf("UDP %v bytes", len(message))
-			_, err := conn.Write(message)
-			if err != nil {
-				log.Printf("Error: %v", err)
-			}
-		}
-		time.Sleep(2 * time.Second)
+		defer admin.Close()
 	}
-}
-
-func main() {
-	o := Options{}
 
-	flag.StringVar(&o.Names, "names", "fake0", "")
-	flag.BoolVar(&o.NoModules, "no-modules", false, "")
-	flag.IntVar(&o.PrimeReadings, "prime-readings", 0, "")
-	flag.Float64Var(&o.Latitude, "latitude", 0, "")
-	flag.Float64Var(&o.Longitude, "longitude", 0, "")
-	flag.Parse()
-
-	names := strings.Split(o.Names, ",")
-	devices := CreateFakeDevicesNamed(names, o.NoModules, float32(o.Latitude), float32(o.Longitude))
-
-	if o.PrimeReadings > 0 {
-		for _, device := range devices {
-			device.State.Streams[0].Open()
-			device.State.Streams[1].Open()
+	discovery := simulator.DiscoveryOptions{
+		Group:     o.UdpGroup,
+		Port:      o.UdpPort,
+		Interval:  time.Duration(o.UdpInterval * float64(time.Second)),
+		TTL:       o.UdpTtl,
+		Broadcast: o.UdpBroadcast,
+		Addresses: simulator.AddressOptions{
+			Interface: o.UdpInterface,
+			Loopback:  o.UdpLoopback,
+			IPv6:      o.UdpIpv6,
+		},
+	}
 
-			device.State.Streams[1].AppendConfiguration()
+	ctx, cancel := context.WithCancel(context.Background())
 
-			for i := 0; i < o.PrimeReadings; i += 1 {
-				device.State.Streams[0].AppendReading()
-			}
-		}
-	}
+	published := make(chan struct{})
 
-	dispatcher := NewDispatcher()
-	dispatcher.AddHandler(pb.QueryType_QUERY_STATUS, handleQueryReadings)
-	dispatcher.AddHandler(pb.QueryType_QUERY_TAKE_READINGS, handleQueryTakeReadings)
-	dispatcher.AddHandler(pb.QueryType_QUERY_GET_READINGS, handleQueryReadings)
-	dispatcher.AddHandler(pb.QueryType_QUERY_CONFIGURE, handleConfigure)
-	dispatcher.AddHandler(pb.QueryType_QUERY_RECORDING_CONTROL, handleRecordingControl)
-	dispatcher.AddHandler(pb.QueryType_QUERY_SCAN_NETWORKS, handleQueryScanNetworks)
-	dispatcher.AddHandler(pb.QueryType_QUERY_SCAN_MODULES, handleQueryStatus)
-
-	for _, device := range devices {
-		device.Start(dispatcher)
-		go device.FakeReadings()
-		defer device.Close()
-	}
+	// Say goodbye before the stations close.
+	defer func() {
+		cancel()
+		<-published
+	}()
 
 	go func() {
-		err := PublishDnsDiscovery(fmt.Sprintf("224.1.2.3:%d", 22143), devices)
+		defer close(published)
+		err := simulator.PublishDnsDiscovery(ctx, discovery, sim.Stations)
 		if err != nil {
 			log.Printf("Error: %v", err)
 		}
 	}()
 
+	finished := make(chan error, 1)
+
+	if scenario != nil {
+		runner := simulator.NewScenarioRunner(sim.Stations)
+		go func() {
+			finished <- runner.Run(ctx, scenario)
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	for sig := range c {
-		if sig == os.Interrupt {
-			break
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+running:
+	for {
+		select {
+		case sig := <-c:
+			if sig == os.Interrupt || sig == syscall.SIGTERM {
+				log.Printf("Stopping (%v)", sig)
+				break running
+			}
+			if sig == syscall.SIGHUP && o.Faults != "" {
+				rules, err := simulator.LoadFaultRules(o.Faults)
+				if err != nil {
+					log.Printf("Error: %v", err)
+					continue
+				}
+
+				sim.Environment.Faults.SetRules(rules)
+			}
+		case err := <-finished:
+			if err != nil {
+				log.Printf("Error: %v", err)
+			}
+			if o.ScenarioExit {
+				if err != nil {
+					status = 1
+				}
+				break running
+			}
 		}
 	}
 
@@ -0,0 +1,692 @@
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AdminServer struct {
+	stations  *Stations
+	env       *Environment
+	latitude  float32
+	longitude float32
+	server    *http.Server
+}
+
+type ModuleView struct {
+	Position   int    `json:"position"`
+	Sensor     string `json:"sensor"`
+	Generation uint32 `json:"generation"`
+	Calibrated bool   `json:"calibrated"`
+}
+
+type StreamView struct {
+	File   string `json:"file"`
+	Record uint64 `json:"record"`
+	Size   uint64 `json:"size"`
+}
+
+type PowerView struct {
+	BatteryVoltage    uint32 `json:"battery_voltage"`
+	BatteryPercentage uint32 `json:"battery_percentage"`
+	SolarVoltage      uint32 `json:"solar_voltage"`
+}
+
+type GpsView struct {
+	Fix        uint32  `json:"fix"`
+	Satellites uint32  `json:"satellites"`
+	Latitude   float32 `json:"latitude"`
+	Longitude  float32 `json:"longitude"`
+	Fixed      bool    `json:"fixed"`
+}
+
+type DeviceView struct {
+	Name      string        `json:"name"`
+	DeviceId  string        `json:"device_id"`
+	Port      int           `json:"port"`
+	TlsPort   int           `json:"tls_port"`
+	Url       string        `json:"url"`
+	Online    bool          `json:"online"`
+	Recording bool          `json:"recording"`
+	Modules   []*ModuleView `json:"modules"`
+	Attached  []*ModuleView `json:"attached"`
+	Power     *PowerView    `json:"power"`
+	Gps       *GpsView      `json:"gps"`
+	Data      *StreamView   `json:"data"`
+	Meta      *StreamView   `json:"meta"`
+}
+
+// Admin requests use pointers so that omitted fields are left alone. They're
+// also the steps of scenarios, so they're applied with the device's lock held.
+type PowerUpdate struct {
+	BatteryVoltage    *uint32 `yaml:"battery_voltage" json:"battery_voltage"`
+	BatteryPercentage *uint32 `yaml:"battery_percentage" json:"battery_percentage"`
+	SolarVoltage      *uint32 `yaml:"solar_voltage" json:"solar_voltage"`
+}
+
+func (u *PowerUpdate) Validate() error {
+	if u.BatteryPercentage != nil && *u.BatteryPercentage > 100 {
+		return fmt.Errorf("battery_percentage: %d is out of range", *u.BatteryPercentage)
+	}
+	return nil
+}
+
+// Apply sets the battery's charge, from the voltage when there's no
+// percentage, and pins the solar panel's voltage.
+func (u *PowerUpdate) Apply(device *FakeDevice) {
+	device.updatePower()
+	if u.BatteryVoltage != nil {
+		device.PowerModel.SetVoltage(float64(*u.BatteryVoltage))
+	}
+	if u.BatteryPercentage != nil {
+		device.PowerModel.SetPercentage(float64(*u.BatteryPercentage))
+	}
+	if u.SolarVoltage != nil {
+		device.PowerModel.PinSolarVoltage(float64(*u.SolarVoltage))
+	}
+	device.updatePower()
+}
+
+type GpsUpdate struct {
+	Fix        *uint32  `yaml:"fix" json:"fix"`
+	Satellites *uint32  `yaml:"satellites" json:"satellites"`
+	Latitude   *float32 `yaml:"latitude" json:"latitude"`
+	Longitude  *float32 `yaml:"longitude" json:"longitude"`
+	Fixed      *bool    `yaml:"fixed" json:"fixed"`
+	ColdStart  bool     `yaml:"cold_start" json:"cold_start"`
+}
+
+func (u *GpsUpdate) Validate() error {
+	if u.Latitude != nil && (*u.Latitude < -90 || *u.Latitude > 90) {
+		return fmt.Errorf("latitude: %v is out of range", *u.Latitude)
+	}
+	if u.Longitude != nil && (*u.Longitude < -180 || *u.Longitude > 180) {
+		return fmt.Errorf("longitude: %v is out of range", *u.Longitude)
+	}
+	return nil
+}
+
+func (u *GpsUpdate) Apply(device *FakeDevice) {
+	device.updateGps()
+	if u.ColdStart {
+		device.GpsModel.ColdStart(device.Now())
+	}
+	if u.Fix != nil {
+		device.GpsModel.PinFix(*u.Fix > 0)
+	}
+	if u.Satellites != nil {
+		device.GpsModel.SetSatellites(*u.Satellites)
+	}
+	if u.Latitude != nil {
+		device.Latitude = *u.Latitude
+	}
+	if u.Longitude != nil {
+		device.Longitude = *u.Longitude
+	}
+	if u.Fixed != nil {
+		device.GpsModel.SetFixed(*u.Fixed)
+	}
+	device.updateGps()
+	device.SaveState()
+}
+
+type RecordingUpdate struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+}
+
+func (u *RecordingUpdate) Apply(device *FakeDevice) {
+	device.SetRecording(u.Enabled)
+	device.SaveState()
+}
+
+type FirmwareUpdate struct {
+	Failure       *string  `yaml:"failure" json:"failure"`
+	RebootSeconds *float64 `yaml:"reboot_seconds" json:"reboot_seconds"`
+}
+
+func (u *FirmwareUpdate) Validate() error {
+	if u.Failure != nil {
+		if err := ValidateFirmwareFailure(*u.Failure); err != nil {
+			return fmt.Errorf("failure: %v", err)
+		}
+	}
+	if u.RebootSeconds != nil && *u.RebootSeconds < 0 {
+		return fmt.Errorf("reboot_seconds: %v is negative", *u.RebootSeconds)
+	}
+	return nil
+}
+
+func (u *FirmwareUpdate) Apply(device *FakeDevice) {
+	if u.Failure != nil {
+		device.FirmwareFailure = *u.Failure
+	}
+	if u.RebootSeconds != nil {
+		device.RebootDuration = time.Duration(*u.RebootSeconds * float64(time.Second))
+	}
+}
+
+type ReadingsRequest struct {
+	Count int `yaml:"count" json:"count"`
+}
+
+func (r *ReadingsRequest) Validate() error {
+	if r.Count < 0 {
+		return fmt.Errorf("count: %d is negative", r.Count)
+	}
+	return nil
+}
+
+// Apply appends readings immediately, regardless of recording. They're spaced
+// by the readings schedule from now, or from after the last record when that's
+// later, so that time still grows with the record number.
+func (r *ReadingsRequest) Apply(device *FakeDevice) {
+	stream := device.State.Streams[0]
+	interval := device.readingsInterval()
+
+	start := device.Now()
+	if status := stream.Status(); status.Record > 0 {
+		if last := time.Unix(int64(status.Time), 0); !start.After(last) {
+			start = last.Add(interval)
+		}
+	}
+
+	for i := 0; i < r.Count; i += 1 {
+		stream.AppendReadingAt(device, start.Add(interval*time.Duration(i)))
+	}
+
+	device.Reschedule()
+}
+
+type adminError struct {
+	status  int
+	message string
+}
+
+func (e *adminError) Error() string {
+	return e.message
+}
+
+func badRequest(f string, args ...interface{}) error {
+	return &adminError{status: http.StatusBadRequest, message: fmt.Sprintf(f, args...)}
+}
+
+func notFound(f string, args ...interface{}) error {
+	return &adminError{status: http.StatusNotFound, message: fmt.Sprintf(f, args...)}
+}
+
+func makeStreamView(ss *StreamState) *StreamView {
+	status := ss.Status()
+	return &StreamView{
+		File:   ss.File,
+		Record: status.Record,
+		Size:   status.Size,
+	}
+}
+
+func makeModuleViews(modules []*FakeModule) []*ModuleView {
+	views := make([]*ModuleView, 0)
+	for _, m := range modules {
+		views = append(views, &ModuleView{
+			Position:   m.Position,
+			Sensor:     SensorTypeName(m.SensorType),
+			Generation: m.Generation,
+			Calibrated: m.Calibrated(),
+		})
+	}
+	return views
+}
+
+// Modules are the ones the station found when it last scanned, attached are
+// the ones on its bus now.
+func makeDeviceView(device *FakeDevice) *DeviceView {
+	device.updatePower()
+	device.updateGps()
+
+	return &DeviceView{
+		Name:      device.Name,
+		DeviceId:  device.DeviceId,
+		Port:      device.Port,
+		TlsPort:   device.TlsPort,
+		Url:       device.BaseUrl(),
+		Online:    device.online,
+		Recording: device.State.Recording,
+		Modules:   makeModuleViews(device.Modules),
+		Attached:  makeModuleViews(device.Bus()),
+		Power: &PowerView{
+			BatteryVoltage:    device.Power.Battery.Voltage,
+			BatteryPercentage: device.Power.Battery.Percentage,
+			SolarVoltage:      device.Power.Solar.Voltage,
+		},
+		Gps: &GpsView{
+			Fix:        device.Gps.Fix,
+			Satellites: device.Gps.Satellites,
+			Latitude:   device.Gps.Latitude,
+			Longitude:  device.Gps.Longitude,
+			Fixed:      device.GpsModel.Fixed(),
+		},
+		Data: makeStreamView(device.State.Streams[0]),
+		Meta: makeStreamView(device.State.Streams[1]),
+	}
+}
+
+func NewAdminServer(stations *Stations, env *Environment, bind string, port int, latitude, longitude float32) (*AdminServer, error) {
+	as := &AdminServer{
+		stations:  stations,
+		env:       env,
+		latitude:  latitude,
+		longitude: longitude,
+	}
+
+	as.server = &http.Server{
+		Addr:    net.JoinHostPort(bind, strconv.Itoa(port)),
+		Handler: as,
+	}
+
+	listener, err := net.Listen("tcp", as.server.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("(admin) listening on %s: %v", as.server.Addr, err)
+	}
+
+	go func() {
+		if err := as.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("(admin) Error: %v", err)
+		}
+	}()
+
+	log.Printf("(admin) Listening on %s", listener.Addr())
+
+	return as, nil
+}
+
+func (as *AdminServer) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	if err := as.server.Shutdown(ctx); err != nil {
+		as.server.Close()
+	}
+}
+
+func (as *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	log.Printf("(admin) %v %v", req.Method, req.URL.Path)
+
+	reply, err := as.route(req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if ae, ok := err.(*adminError); ok {
+			status = ae.status
+		}
+		log.Printf("(admin) Error: %v", err)
+		writeJson(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if reply == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJson(w, http.StatusOK, reply)
+}
+
+func (as *AdminServer) route(req *http.Request) (interface{}, error) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+
+	switch {
+	case parts[0] == "faults" && len(parts) == 1:
+		return as.faults(req)
+	case parts[0] == "devices" && len(parts) == 1:
+		switch req.Method {
+		case http.MethodGet:
+			return as.listDevices()
+		case http.MethodPost:
+			return as.addDevice(req)
+		}
+	case parts[0] == "devices":
+		device := as.stations.Find(parts[1])
+		if device == nil {
+			return nil, notFound("no station named %q", parts[1])
+		}
+		return as.routeDevice(req, device, parts[2:])
+	default:
+		return nil, notFound("unknown path %s", req.URL.Path)
+	}
+
+	return nil, &adminError{status: http.StatusMethodNotAllowed, message: fmt.Sprintf("%s is not allowed on %s", req.Method, req.URL.Path)}
+}
+
+func (as *AdminServer) routeDevice(req *http.Request, device *FakeDevice, parts []string) (interface{}, error) {
+	method := req.Method
+	path := strings.Join(parts, "/")
+
+	// These wait for the station's servers, which may be waiting on its lock.
+	switch {
+	case path == "" && method == http.MethodDelete:
+		return nil, as.stations.Remove(device.Name)
+	case path == "stop" && method == http.MethodPost:
+		device.Stop()
+		return as.deviceView(device), nil
+	case path == "start" && method == http.MethodPost:
+		if err := device.Start(as.stations.dispatcher); err != nil {
+			return nil, err
+		}
+		return as.deviceView(device), nil
+	}
+
+	device.lock.Lock()
+	defer device.lock.Unlock()
+
+	switch {
+	case path == "" && method == http.MethodGet:
+		return makeDeviceView(device), nil
+	case path == "modules" && method == http.MethodPost:
+		return as.attachModule(req, device)
+	case path == "modules/scan" && method == http.MethodPost:
+		device.ScanModules()
+		return makeDeviceView(device), nil
+	case len(parts) == 2 && parts[0] == "modules" && method == http.MethodPut:
+		return as.swapModule(req, device, parts[1])
+	case len(parts) == 2 && parts[0] == "modules" && method == http.MethodDelete:
+		return as.detachModule(device, parts[1])
+	case path == "power" && method == http.MethodPut:
+		return as.setPower(req, device)
+	case path == "gps" && method == http.MethodPut:
+		return as.setGps(req, device)
+	case path == "recording" && method == http.MethodPut:
+		return as.setRecording(req, device)
+	case path == "firmware" && method == http.MethodPut:
+		return as.setFirmware(req, device)
+	case path == "readings" && method == http.MethodPost:
+		return as.appendReadings(req, device)
+	case path == "streams/reset" && method == http.MethodPost:
+		return as.resetStreams(device)
+	}
+
+	return nil, notFound("unknown path %s %s", method, req.URL.Path)
+}
+
+func (as *AdminServer) deviceView(device *FakeDevice) *DeviceView {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	return makeDeviceView(device)
+}
+
+func (as *AdminServer) listDevices() (interface{}, error) {
+	views := make([]*DeviceView, 0)
+	for _, device := range as.stations.All() {
+		views = append(views, as.deviceView(device))
+	}
+	return views, nil
+}
+
+// Stations are added using the same fields as a station in a profile.
+func (as *AdminServer) addDevice(req *http.Request) (interface{}, error) {
+	station := &StationProfile{}
+	if err := readJson(req, station); err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{
+		Stations: []*StationProfile{station},
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, badRequest("%v", err)
+	}
+
+	port := station.Port
+	if port == 0 {
+		port = as.stations.NextPort()
+	}
+
+	device := NewFakeDevice(as.env, station.Name, port, as.latitude, as.longitude)
+	device.Bind = as.stations.bind
+
+	if station.TlsPort > 0 {
+		device.TlsPort = station.TlsPort
+	}
+
+	station.Apply(device)
+
+	if _, err := device.RestoreState(); err != nil {
+		return nil, err
+	}
+
+	if err := as.stations.Add(device); err != nil {
+		return nil, &adminError{status: http.StatusConflict, message: err.Error()}
+	}
+
+	return as.deviceView(device), nil
+}
+
+func (as *AdminServer) readModule(req *http.Request, device *FakeDevice, position *int) (*FakeModule, error) {
+	mp := &ModuleProfile{}
+	if err := readJson(req, mp); err != nil {
+		return nil, err
+	}
+
+	if position != nil {
+		mp.Position = *position
+	}
+
+	station := &StationProfile{
+		Modules: []*ModuleProfile{mp},
+	}
+	if err := station.validate(); err != nil {
+		return nil, badRequest("%v", err)
+	}
+
+	return mp.toModule(device), nil
+}
+
+func parsePosition(value string) (int, error) {
+	position, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, badRequest("invalid position %q", value)
+	}
+	return position, nil
+}
+
+func (as *AdminServer) attachModule(req *http.Request, device *FakeDevice) (interface{}, error) {
+	module, err := as.readModule(req, device, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := device.AttachModule(module); err != nil {
+		return nil, &adminError{status: http.StatusConflict, message: err.Error()}
+	}
+
+	return makeDeviceView(device), nil
+}
+
+func (as *AdminServer) swapModule(req *http.Request, device *FakeDevice, value string) (interface{}, error) {
+	position, err := parsePosition(value)
+	if err != nil {
+		return nil, err
+	}
+
+	module, err := as.readModule(req, device, &position)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := device.SwapModule(module); err != nil {
+		return nil, notFound("%v", err)
+	}
+
+	return makeDeviceView(device), nil
+}
+
+func (as *AdminServer) detachModule(device *FakeDevice, value string) (interface{}, error) {
+	position, err := parsePosition(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := device.DetachModule(position); err != nil {
+		return nil, notFound("%v", err)
+	}
+
+	return makeDeviceView(device), nil
+}
+
+func (as *AdminServer) setPower(req *http.Request, device *FakeDevice) (interface{}, error) {
+	update := &PowerUpdate{}
+	if err := readJson(req, update); err != nil {
+		return nil, err
+	}
+
+	if err := update.Validate(); err != nil {
+		return nil, badRequest("%v", err)
+	}
+
+	update.Apply(device)
+
+	return makeDeviceView(device), nil
+}
+
+func (as *AdminServer) setGps(req *http.Request, device *FakeDevice) (interface{}, error) {
+	update := &GpsUpdate{}
+	if err := readJson(req, update); err != nil {
+		return nil, err
+	}
+
+	if err := update.Validate(); err != nil {
+		return nil, badRequest("%v", err)
+	}
+
+	update.Apply(device)
+
+	return makeDeviceView(device), nil
+}
+
+func (as *AdminServer) setRecording(req *http.Request, device *FakeDevice) (interface{}, error) {
+	update := &RecordingUpdate{}
+	if err := readJson(req, update); err != nil {
+		return nil, err
+	}
+
+	update.Apply(device)
+
+	return makeDeviceView(device), nil
+}
+
+func (as *AdminServer) setFirmware(req *http.Request, device *FakeDevice) (interface{}, error) {
+	update := &FirmwareUpdate{}
+	if err := readJson(req, update); err != nil {
+		return nil, err
+	}
+
+	if err := update.Validate(); err != nil {
+		return nil, badRequest("%v", err)
+	}
+
+	update.Apply(device)
+
+	return makeDeviceView(device), nil
+}
+
+func (as *AdminServer) appendReadings(req *http.Request, device *FakeDevice) (interface{}, error) {
+	request := &ReadingsRequest{
+		Count: 1,
+	}
+	if err := readJson(req, request); err != nil {
+		return nil, err
+	}
+
+	if err := request.Validate(); err != nil {
+		return nil, badRequest("%v", err)
+	}
+
+	request.Apply(device)
+
+	return makeDeviceView(device), nil
+}
+
+func (as *AdminServer) resetStreams(device *FakeDevice) (interface{}, error) {
+	for _, stream := range device.State.Streams {
+		if err := stream.Reset(); err != nil {
+			return nil, err
+		}
+	}
+
+	device.State.Streams[1].AppendConfiguration(device)
+
+	return makeDeviceView(device), nil
+}
+
+// GET lists the rules, PUT replaces them all and POST adds one.
+func (as *AdminServer) faults(req *http.Request) (interface{}, error) {
+	faults := as.env.Faults
+
+	switch req.Method {
+	case http.MethodGet:
+		return faults.Rules(), nil
+	case http.MethodPut:
+		rules := &FaultRules{}
+		if err := readJson(req, rules); err != nil {
+			return nil, err
+		}
+		for i, rule := range rules.Rules {
+			if rule == nil {
+				return nil, badRequest("rules[%d]: empty rule", i)
+			}
+			if err := rule.Validate(); err != nil {
+				return nil, badRequest("rules[%d].%v", i, err)
+			}
+		}
+		faults.SetRules(rules.Rules)
+		return faults.Rules(), nil
+	case http.MethodPost:
+		rule := &FaultRule{}
+		if err := readJson(req, rule); err != nil {
+			return nil, err
+		}
+		if err := faults.AddRule(rule); err != nil {
+			return nil, badRequest("%v", err)
+		}
+		return faults.Rules(), nil
+	}
+
+	return nil, &adminError{status: http.StatusMethodNotAllowed, message: fmt.Sprintf("%s is not allowed on %s", req.Method, req.URL.Path)}
+}
+
+// An empty body leaves the defaults in value untouched, unknown fields are
+// refused so that a misspelled one isn't quietly ignored.
+func readJson(req *http.Request, value interface{}) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	if len(body) == 0 {
+		return nil
+	}
+
+	if err := unmarshalJsonStrict(body, value); err != nil {
+		return badRequest("invalid json: %v", err)
+	}
+
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,235 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/golang/protobuf/proto"
+
+	pbatlas "github.com/fieldkit/atlas-protocol"
+	pbdata "github.com/fieldkit/data-protocol"
+)
+
+const (
+	ProbeGainError   = 0.08
+	ProbeOffsetError = 0.05
+)
+
+// Probe is how far a module reads from the truth before it's calibrated, the
+// uncalibrated value is Gain * true + Offset.
+type Probe struct {
+	Gain   float64
+	Offset float64
+}
+
+// NewProbe makes a probe that's off by up to ProbeGainError in gain and by up
+// to ProbeOffsetError of the sensor's typical value in offset.
+func NewProbe(sensorType pbatlas.SensorType, seed int64) Probe {
+	rng := rand.New(rand.NewSource(seed))
+	base := math.Abs(defaultSignalParameters[sensorType].Base)
+	return Probe{
+		Gain:   1 + (rng.Float64()*2-1)*ProbeGainError,
+		Offset: (rng.Float64()*2 - 1) * ProbeOffsetError * base,
+	}
+}
+
+func (p Probe) Read(value float32) float32 {
+	return float32(p.Gain*float64(value) + p.Offset)
+}
+
+// ParseModuleConfiguration decodes a module's configuration, which like the
+// firmware is a length delimited ModuleConfiguration.
+func ParseModuleConfiguration(data []byte) (*pbdata.ModuleConfiguration, error) {
+	config := &pbdata.ModuleConfiguration{}
+	if len(data) == 0 {
+		return config, nil
+	}
+	buf := proto.NewBuffer(data)
+	if err := buf.DecodeMessage(config); err != nil {
+		return nil, fmt.Errorf("invalid module configuration: %v", err)
+	}
+	return config, nil
+}
+
+func encodeModuleConfiguration(config *pbdata.ModuleConfiguration) ([]byte, error) {
+	buf := proto.NewBuffer(make([]byte, 0))
+	if err := buf.EncodeMessage(config); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// activeCalibration is the calibration readings are corrected with, the most
+// recent one when several are kept.
+func activeCalibration(config *pbdata.ModuleConfiguration) *pbdata.Calibration {
+	if config == nil {
+		return nil
+	}
+	if config.Calibration != nil {
+		return config.Calibration
+	}
+	if len(config.Calibrations) > 0 {
+		return config.Calibrations[len(config.Calibrations)-1]
+	}
+	return nil
+}
+
+type curveFit struct {
+	x func(float64) float64
+	y func(float64) float64
+	a func(float64) float64
+}
+
+func identity(v float64) float64 {
+	return v
+}
+
+// Every curve is fit as a line after transforming the points, the intercept
+// is then transformed back by a.
+var curveFits = map[pbdata.CurveType]curveFit{
+	pbdata.CurveType_CURVE_LINEAR:      curveFit{x: identity, y: identity, a: identity},
+	pbdata.CurveType_CURVE_POWER:       curveFit{x: math.Log, y: math.Log, a: math.Exp},
+	pbdata.CurveType_CURVE_LOGARITHMIC: curveFit{x: math.Log, y: identity, a: identity},
+	pbdata.CurveType_CURVE_EXPONENTIAL: curveFit{x: identity, y: math.Log, a: math.Exp},
+}
+
+// FitCalibration computes the coefficients of a calibration from its points,
+// unless they were given. A single point only corrects the offset.
+func FitCalibration(cal *pbdata.Calibration) error {
+	if cal.Coefficients != nil && len(cal.Coefficients.Values) > 0 {
+		return nil
+	}
+
+	if cal.Type == pbdata.CurveType_CURVE_NONE {
+		cal.Type = pbdata.CurveType_CURVE_LINEAR
+	}
+
+	fit, ok := curveFits[cal.Type]
+	if !ok {
+		return fmt.Errorf("unknown curve type %v", cal.Type)
+	}
+
+	xs := make([]float64, 0)
+	ys := make([]float64, 0)
+	for i, point := range cal.Points {
+		if len(point.References) == 0 || len(point.Uncalibrated) == 0 {
+			return fmt.Errorf("point %d needs a reference and an uncalibrated value", i)
+		}
+		x := fit.x(float64(point.Uncalibrated[0]))
+		y := fit.y(float64(point.References[0]))
+		if math.IsNaN(x) || math.IsInf(x, 0) || math.IsNaN(y) || math.IsInf(y, 0) {
+			return fmt.Errorf("point %d is out of range for curve %v", i, cal.Type)
+		}
+		xs = append(xs, x)
+		ys = append(ys, y)
+	}
+
+	if len(xs) == 0 {
+		return errors.New("calibration has no points")
+	}
+
+	slope := 1.0
+	if len(xs) > 1 {
+		var mx, my float64
+		for i := range xs {
+			mx += xs[i]
+			my += ys[i]
+		}
+		mx /= float64(len(xs))
+		my /= float64(len(ys))
+
+		var sxy, sxx float64
+		for i := range xs {
+			sxy += (xs[i] - mx) * (ys[i] - my)
+			sxx += (xs[i] - mx) * (xs[i] - mx)
+		}
+		if sxx == 0 {
+			return errors.New("calibration points need different uncalibrated values")
+		}
+		slope = sxy / sxx
+	}
+
+	var intercept float64
+	for i := range xs {
+		intercept += ys[i] - slope*xs[i]
+	}
+	intercept /= float64(len(xs))
+
+	cal.Coefficients = &pbdata.CalibrationCoefficients{
+		Values: []float32{float32(fit.a(intercept)), float32(slope)},
+	}
+
+	return nil
+}
+
+// Calibrate corrects an uncalibrated value, coefficients are the intercept
+// and then the slope like the firmware's curves.
+func Calibrate(cal *pbdata.Calibration, value float32) float32 {
+	if cal == nil || cal.Coefficients == nil || len(cal.Coefficients.Values) < 2 {
+		return value
+	}
+
+	a := float64(cal.Coefficients.Values[0])
+	b := float64(cal.Coefficients.Values[1])
+	x := float64(value)
+
+	switch cal.Type {
+	case pbdata.CurveType_CURVE_LINEAR:
+		return float32(a + b*x)
+	case pbdata.CurveType_CURVE_POWER:
+		return float32(a * math.Pow(x, b))
+	case pbdata.CurveType_CURVE_LOGARITHMIC:
+		return float32(a + b*math.Log(x))
+	case pbdata.CurveType_CURVE_EXPONENTIAL:
+		return float32(a * math.Exp(b*x))
+	}
+
+	return value
+}
+
+// Configure applies a configuration from the app, fitting any calibrations
+// that only have points. The stored configuration includes the coefficients.
+func (m *FakeModule) Configure(data []byte, now uint32) error {
+	config, err := ParseModuleConfiguration(data)
+	if err != nil {
+		return err
+	}
+
+	calibrations := config.Calibrations
+	if config.Calibration != nil {
+		calibrations = append([]*pbdata.Calibration{config.Calibration}, calibrations...)
+	}
+
+	for _, cal := range calibrations {
+		if err := FitCalibration(cal); err != nil {
+			return err
+		}
+		if cal.Time == 0 {
+			cal.Time = now
+		}
+	}
+
+	if len(data) > 0 {
+		data, err = encodeModuleConfiguration(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.Configuration = data
+	m.calibration = activeCalibration(config)
+
+	return nil
+}
+
+// ClearCalibration forgets the module's configuration, like the app's reset.
+func (m *FakeModule) ClearCalibration() {
+	m.Configuration = nil
+	m.calibration = nil
+}
+
+func (m *FakeModule) Calibrated() bool {
+	return m.calibration != nil
+}
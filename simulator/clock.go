@@ -0,0 +1,274 @@
+package simulator
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	SteppedClockYield = 10 * time.Millisecond
+)
+
+// Clock is the only source of time used by the simulator, so that runs can be
+// replayed and history generated faster than real time.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) *Timer
+}
+
+// Timer is a Clock's time.Timer, waiters that give up on one should Stop it
+// so it doesn't hold a stepped clock back.
+type Timer struct {
+	C    <-chan time.Time
+	stop func() bool
+}
+
+func (t *Timer) Stop() bool {
+	return t.stop()
+}
+
+type SystemClock struct {
+}
+
+func (c *SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *SystemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (c *SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *SystemClock) NewTimer(d time.Duration) *Timer {
+	timer := time.NewTimer(d)
+	return &Timer{
+		C:    timer.C,
+		stop: timer.Stop,
+	}
+}
+
+// ScaledClock starts at a fixed epoch and advances Scale times faster than
+// real time, so a Scale of 3600 runs an hour of station time every second. A
+// Scale of 0 stops the clock and steps it instead: once everything has had
+// SteppedClockYield to react to the last step, time jumps to the earliest
+// timer anyone is waiting on and every timer due then fires together. Time
+// doesn't depend on how many stations are waiting, so runs are reproducible
+// as long as nothing takes longer than that to react.
+type ScaledClock struct {
+	lock     sync.Mutex
+	epoch    time.Time
+	started  time.Time
+	scale    float64
+	offset   time.Duration
+	timers   []*steppedTimer
+	stepping bool
+}
+
+type steppedTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func NewScaledClock(epoch time.Time, scale float64) *ScaledClock {
+	return &ScaledClock{
+		epoch:   epoch,
+		started: time.Now(),
+		scale:   scale,
+	}
+}
+
+func (c *ScaledClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now()
+}
+
+func (c *ScaledClock) now() time.Time {
+	elapsed := time.Duration(float64(time.Since(c.started)) * c.scale)
+	return c.epoch.Add(c.offset + elapsed)
+}
+
+func (c *ScaledClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *ScaledClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C
+}
+
+func (c *ScaledClock) NewTimer(d time.Duration) *Timer {
+	if c.scale != 0 {
+		timer := time.NewTimer(time.Duration(float64(d) / c.scale))
+		return &Timer{
+			C:    timer.C,
+			stop: timer.Stop,
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	st := &steppedTimer{
+		deadline: c.now().Add(d),
+		c:        make(chan time.Time, 1),
+	}
+	c.timers = append(c.timers, st)
+	if !c.stepping {
+		c.stepping = true
+		go c.step()
+	}
+
+	return &Timer{
+		C: st.c,
+		stop: func() bool {
+			return c.remove(st)
+		},
+	}
+}
+
+func (c *ScaledClock) remove(st *steppedTimer) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, t := range c.timers {
+		if t == st {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// step is the one goroutine that moves a stepped clock, running while there
+// are timers waiting.
+func (c *ScaledClock) step() {
+	for {
+		time.Sleep(SteppedClockYield)
+
+		c.lock.Lock()
+		if len(c.timers) == 0 {
+			c.stepping = false
+			c.lock.Unlock()
+			return
+		}
+
+		now := c.now()
+		earliest := c.timers[0].deadline
+		for _, t := range c.timers {
+			if t.deadline.Before(earliest) {
+				earliest = t.deadline
+			}
+		}
+		if earliest.After(now) {
+			c.offset += earliest.Sub(now)
+			now = earliest
+		}
+
+		waiting := make([]*steppedTimer, 0, len(c.timers))
+		for _, t := range c.timers {
+			if t.deadline.After(now) {
+				waiting = append(waiting, t)
+			} else {
+				t.c <- now
+			}
+		}
+		c.timers = waiting
+		c.lock.Unlock()
+	}
+}
+
+// Advance moves the clock forward without waiting.
+func (c *ScaledClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.offset += d
+}
+
+func NewClock(start string, scale float64) (Clock, error) {
+	if scale < 0 {
+		return nil, fmt.Errorf("clock scale must not be negative")
+	}
+	if start == "" && scale == 1 {
+		return &SystemClock{}, nil
+	}
+	epoch := time.Now()
+	if start != "" {
+		parsed, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			return nil, fmt.Errorf("clock start: %v", err)
+		}
+		epoch = parsed
+	}
+	return NewScaledClock(epoch, scale), nil
+}
+
+// Environment is shared by every simulated station and carries what's needed
+// to make a run reproducible. Station files are kept in Directory and Announce
+// controls whether stations publish themselves over ZeroConf, and how.
+type Environment struct {
+	Seed      int64
+	Clock     Clock
+	Faults    *FaultInjector
+	Directory string
+	Announce  bool
+	ZeroConf  ZeroConfOptions
+}
+
+func NewEnvironment(seed int64, clock Clock) *Environment {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	env := &Environment{
+		Seed:     seed,
+		Clock:    clock,
+		Announce: true,
+	}
+	env.Faults = NewFaultInjector(env.NewRandom("faults"))
+	return env
+}
+
+// SeedFor derives a stable seed for something in the simulation from the
+// environment's seed and a key naming it.
+func (e *Environment) SeedFor(key string) int64 {
+	return SeedFromKey(fmt.Sprintf("%d-%s", e.Seed, key))
+}
+
+func (e *Environment) Path(name string) string {
+	return filepath.Join(e.Directory, name)
+}
+
+func (e *Environment) NewRandom(key string) *rand.Rand {
+	return rand.New(&lockedSource{
+		src: rand.NewSource(e.SeedFor(key)).(rand.Source64),
+	})
+}
+
+type lockedSource struct {
+	lock sync.Mutex
+	src  rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.src.Seed(seed)
+}
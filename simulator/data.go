@@ -0,0 +1,120 @@
+package simulator
+
+import (
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/fieldkit/data-protocol"
+)
+
+func makeModuleInfos(device *FakeDevice) []*pb.ModuleInfo {
+	modules := make([]*pb.ModuleInfo, 0)
+	for _, m := range makeModules(device) {
+		sensors := make([]*pb.SensorInfo, 0)
+		for _, s := range m.Sensors {
+			sensors = append(sensors, &pb.SensorInfo{
+				Number:        s.Number,
+				Name:          s.Name,
+				UnitOfMeasure: s.UnitOfMeasure,
+			})
+		}
+		modules = append(modules, &pb.ModuleInfo{
+			Position: m.Position,
+			Name:     m.Name,
+			Id:       m.Id,
+			Flags:    m.Flags,
+			Header: &pb.ModuleHeader{
+				Manufacturer: m.Header.Manufacturer,
+				Kind:         m.Header.Kind,
+				Version:      m.Header.Version,
+			},
+			Firmware: &pb.Firmware{
+				Version: device.Firmware.Version,
+				Build:   device.Firmware.Build,
+				Number:  device.Firmware.Number,
+				Hash:    device.Firmware.Hash,
+			},
+			Sensors:       sensors,
+			Configuration: m.Configuration,
+		})
+	}
+	return modules
+}
+
+func generateFakeConfiguration(device *FakeDevice) *pb.SignedRecord {
+	cfg := &pb.DataRecord{
+		Modules: makeModuleInfos(device),
+	}
+
+	body := proto.NewBuffer(make([]byte, 0))
+	body.EncodeMessage(cfg)
+
+	hash := blake2b.Sum256(body.Bytes())
+
+	return &pb.SignedRecord{
+		Kind: 1, /* Modules */
+		Time: 0,
+		Data: body.Bytes(),
+		Hash: hash[:],
+	}
+}
+
+func makeSensorGroups(device *FakeDevice, now time.Time) []*pb.SensorGroup {
+	groups := make([]*pb.SensorGroup, 0)
+	for i, m := range makeModules(device) {
+		entry := lookupModuleEntry(m.Header)
+		if entry == nil {
+			continue
+		}
+		live := entry.Live(device, m, now)
+		readings := make([]*pb.SensorAndValue, 0)
+		for _, r := range live.Readings {
+			readings = append(readings, &pb.SensorAndValue{
+				Sensor: r.Sensor.Number,
+				Value:  r.Value,
+			})
+		}
+		groups = append(groups, &pb.SensorGroup{
+			Module:   uint32(i),
+			Readings: readings,
+		})
+	}
+	return groups
+}
+
+// makeDeviceLocation is the location stored with a reading taken at now,
+// which may be in the past when priming the stream. The fix is the one at that
+// time rather than the current one. The caller holds the lock.
+func makeDeviceLocation(device *FakeDevice, now time.Time) *pb.DeviceLocation {
+	device.updateGps()
+
+	fix, satellites := device.GpsModel.StatusAt(now)
+
+	location := &pb.DeviceLocation{
+		Enabled:    1,
+		Time:       int64(now.Unix()),
+		Satellites: satellites,
+	}
+	if fix {
+		location.Fix = 1
+		location.Latitude, location.Longitude, location.Altitude = device.GpsModel.Position(now, device.Latitude, device.Longitude)
+	}
+
+	return location
+}
+
+func generateFakeReading(device *FakeDevice, reading uint32, meta uint64, now time.Time) *pb.DataRecord {
+	return &pb.DataRecord{
+		Readings: &pb.Readings{
+			Time:         int64(now.Unix()),
+			Reading:      uint64(reading),
+			Flags:        0,
+			Meta:         meta,
+			Location:     makeDeviceLocation(device, now),
+			SensorGroups: makeSensorGroups(device, now),
+		},
+	}
+}
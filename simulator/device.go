@@ -0,0 +1,526 @@
+package simulator
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/fieldkit/app-protocol"
+	pbatlas "github.com/fieldkit/atlas-protocol"
+	pbdata "github.com/fieldkit/data-protocol"
+)
+
+type HardwareState struct {
+	Identity      pb.Identity
+	Lora          *pb.LoraSettings
+	Streams       [2]*StreamState
+	Networks      []*pb.NetworkInfo
+	ReadingsReady bool
+	Recording     bool
+	StartedTime   uint64
+}
+
+type FakeModule struct {
+	Position      int
+	SensorType    pbatlas.SensorType
+	Configuration []byte
+	Signal        Signal
+	Probe         Probe
+	Generation    uint32
+	calibration   *pbdata.Calibration
+}
+
+func NewFakeModule(env *Environment, name string, position int, sensorType pbatlas.SensorType) *FakeModule {
+	return &FakeModule{
+		Position:   position,
+		SensorType: sensorType,
+		Signal:     NewDefaultSignal(sensorType, env.SeedFor(fmt.Sprintf("%s-%d", name, position))),
+		Probe:      NewProbe(sensorType, env.SeedFor(fmt.Sprintf("%s-%d-probe", name, position))),
+	}
+}
+
+type FakeDevice struct {
+	Name             string
+	DeviceId         string
+	Bind             string
+	Port             int
+	TlsPort          int
+	ZeroConf         *ZeroConf
+	WebServer        *HttpServer
+	State            *HardwareState
+	Latitude         float32
+	Longitude        float32
+	HaveLocation     bool
+	Gps              *pb.GpsStatus
+	GpsModel         *GpsModel
+	Enclosure        Signal
+	Modules          []*FakeModule
+	ModuleGeneration uint32
+	Environment      *Environment
+	Random           *rand.Rand
+	ReadingsSchedule *pb.Schedule
+	LoraSchedule     *pb.Schedule
+	NetworkSchedule  *pb.Schedule
+	GpsSchedule      *pb.Schedule
+	Power            *pb.PowerStatus
+	PowerModel       *PowerModel
+	Firmware         *pb.Firmware
+	FirmwareSize     uint32
+	FirmwareFailure  string
+	RebootDuration   time.Duration
+	BootTime         time.Time
+	Logs             *DeviceLog
+	requests         int32
+	dispatcher       *Dispatcher
+	reschedule       chan bool
+	closed           chan bool
+	online           bool
+	attached         []*FakeModule
+	browned          bool
+	rebooting        bool
+	reboots          sync.WaitGroup
+	announcing       sync.Mutex
+	lock             sync.Mutex
+}
+
+func (fd *FakeDevice) Now() time.Time {
+	return fd.Environment.Clock.Now()
+}
+
+// PrimeReadings fills the data stream with history, spacing readings by the
+// readings schedule and ending at the current time.
+func (fd *FakeDevice) PrimeReadings(count int) {
+	interval := fd.readingsInterval()
+	started := fd.Now().Add(-interval * time.Duration(count))
+
+	for i := 0; i < count; i += 1 {
+		fd.State.Streams[0].AppendReadingAt(fd, started.Add(interval*time.Duration(i)))
+	}
+}
+
+// readingsInterval is the time between readings on the readings schedule.
+func (fd *FakeDevice) readingsInterval() time.Duration {
+	interval := time.Duration(fd.ReadingsSchedule.Interval) * time.Second
+	if interval == 0 {
+		interval = time.Minute
+	}
+	return interval
+}
+
+func (fd *FakeDevice) ModuleAt(position int) *FakeModule {
+	for _, m := range fd.Modules {
+		if m.Position == position {
+			return m
+		}
+	}
+	return nil
+}
+
+// Uptime is the time since the station booted, in milliseconds like the
+// firmware reports it.
+func (fd *FakeDevice) Uptime() uint32 {
+	return fd.UptimeAt(fd.Now())
+}
+
+// UptimeAt is the uptime at a time since the station booted, and 0 before.
+func (fd *FakeDevice) UptimeAt(now time.Time) uint32 {
+	if now.Before(fd.BootTime) {
+		return 0
+	}
+	return uint32(now.Sub(fd.BootTime) / time.Millisecond)
+}
+
+// randomAt is a generator for values that belong to a time rather than to when
+// they're read, so stored records don't change with how often the app polls.
+func (fd *FakeDevice) randomAt(key string, now time.Time) *rand.Rand {
+	return rand.New(rand.NewSource(fd.Environment.SeedFor(fmt.Sprintf("%s-%s", fd.Name, key)) + now.Unix()))
+}
+
+// Start brings the station online, serving the API and announcing itself.
+func (fd *FakeDevice) Start(dispatcher *Dispatcher) error {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+
+	if fd.online || fd.isClosed() {
+		return nil
+	}
+
+	fd.dispatcher = dispatcher
+
+	ws, err := NewHttpServer(fd, dispatcher)
+	if err != nil {
+		return err
+	}
+
+	fd.WebServer = ws
+
+	if err := fd.announce(); err != nil {
+		fd.WebServer = nil
+		ws.Close()
+		return err
+	}
+
+	fd.online = true
+
+	return nil
+}
+
+// announce registers the station over ZeroConf, when the environment asks
+// for it. The caller holds the lock.
+func (fd *FakeDevice) announce() error {
+	if !fd.Environment.Announce {
+		return nil
+	}
+
+	zc, err := PublishAddressOverZeroConf(fd, fd.WebServer.Secure(), fd.Environment.ZeroConf)
+	if err != nil {
+		return err
+	}
+
+	fd.ZeroConf = zc
+
+	return nil
+}
+
+// Reannounce replaces the station's ZeroConf registration, so that a new name
+// is advertised. The caller doesn't hold the lock, registering is network I/O.
+func (fd *FakeDevice) Reannounce() error {
+	fd.announcing.Lock()
+	defer fd.announcing.Unlock()
+
+	fd.lock.Lock()
+	old := fd.ZeroConf
+	if !fd.online || old == nil {
+		fd.lock.Unlock()
+		return nil
+	}
+	fd.ZeroConf = nil
+	registration := newZeroConfRegistration(fd, fd.WebServer.Secure(), fd.Environment.ZeroConf)
+	fd.lock.Unlock()
+
+	old.Shutdown()
+
+	zc, err := registration.Publish()
+	if err != nil {
+		return err
+	}
+
+	fd.lock.Lock()
+	if fd.online && fd.ZeroConf == nil {
+		fd.ZeroConf = zc
+		zc = nil
+	}
+	fd.lock.Unlock()
+
+	// Stopped, or stopped and started again, while registering.
+	if zc != nil {
+		zc.Shutdown()
+	}
+
+	return nil
+}
+
+// Stop takes the station off the network, it keeps taking readings.
+func (fd *FakeDevice) Stop() {
+	fd.lock.Lock()
+	if !fd.online {
+		fd.lock.Unlock()
+		return
+	}
+	fd.online = false
+	ws := fd.WebServer
+	zc := fd.ZeroConf
+	fd.ZeroConf = nil
+	fd.lock.Unlock()
+
+	log.Printf("%s offline", fd.Name)
+
+	// Servers wait for requests in progress, which may need the lock.
+	if zc != nil {
+		zc.Shutdown()
+	}
+	ws.Close()
+}
+
+func (fd *FakeDevice) IsOnline() bool {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	return fd.online
+}
+
+// HttpPort is the port the station serves its API on, which is only known
+// once it has started when the port is ephemeral.
+func (fd *FakeDevice) HttpPort() int {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	return fd.Port
+}
+
+// BaseUrl is where the station's API can be reached, the caller holds the
+// device's lock.
+func (fd *FakeDevice) BaseUrl() string {
+	host := fd.Bind
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return fmt.Sprintf("http://%s/fk/v1", net.JoinHostPort(host, strconv.Itoa(fd.Port)))
+}
+
+func (fd *FakeDevice) isClosed() bool {
+	select {
+	case <-fd.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the station for good, ending its readings.
+func (fd *FakeDevice) Close() {
+	log.Printf("%s Close\n", fd.Name)
+
+	fd.lock.Lock()
+	if fd.isClosed() {
+		fd.lock.Unlock()
+		return
+	}
+	close(fd.closed)
+	fd.lock.Unlock()
+
+	fd.Stop()
+
+	// A reboot in progress would otherwise carry on writing the station's
+	// files after it's gone.
+	fd.reboots.Wait()
+}
+
+func (fd *FakeDevice) FakeReadings() {
+	for _, stream := range fd.State.Streams {
+		if err := stream.Open(); err != nil {
+			panic(err)
+		}
+	}
+
+	fd.lock.Lock()
+	fd.State.Streams[1].AppendConfiguration(fd)
+	fd.lock.Unlock()
+
+	last := time.Time{}
+
+	for {
+		var timer *Timer
+		var fired <-chan time.Time
+
+		fd.lock.Lock()
+		if fd.State.Recording {
+			// Readings appended through the admin API may be ahead of now.
+			if status := fd.State.Streams[0].Status(); status.Record > 0 {
+				if appended := time.Unix(int64(status.Time), 0); appended.After(last) {
+					last = appended
+				}
+			}
+			now := fd.Now()
+			from := now
+			if !from.After(last) {
+				from = last.Add(time.Second)
+			}
+			if fd.LowPower() && from.Before(last.Add(LowBatteryReadingInterval)) {
+				from = last.Add(LowBatteryReadingInterval)
+			}
+			next, ok := NextReadingTime(fd.ReadingsSchedule, from)
+			if ok {
+				log.Printf("%s next reading at %v", fd.Name, next)
+				timer = fd.Environment.Clock.NewTimer(next.Sub(now))
+				fired = timer.C
+			}
+		}
+		fd.lock.Unlock()
+
+		select {
+		case <-fired:
+			fd.lock.Lock()
+			if fd.State.Recording && !fd.browned && !fd.rebooting {
+				fd.updatePower()
+				record := fd.State.Streams[0].Status().Record
+				fd.State.Streams[0].AppendReading(fd)
+				fd.PowerModel.Reading()
+				fd.logf("readings", "reading #%d taken", record)
+				last = fd.Now()
+			}
+			fd.lock.Unlock()
+		case <-fd.reschedule:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-fd.closed:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+	}
+}
+
+// The caller holds the device's lock.
+func (fd *FakeDevice) SetRecording(enabled bool) {
+	if enabled {
+		fd.State.Recording = true
+		fd.State.StartedTime = uint64(fd.Now().Unix())
+		fd.logf("recording", "started")
+	} else {
+		fd.State.Recording = false
+		fd.State.StartedTime = 0
+		fd.logf("recording", "stopped")
+	}
+	fd.Reschedule()
+}
+
+// Reschedule wakes the readings loop so that changes to the recording state
+// or the readings schedule take effect immediately.
+func (fd *FakeDevice) Reschedule() {
+	select {
+	case fd.reschedule <- true:
+	default:
+	}
+}
+
+func NewFakeDevice(env *Environment, name string, port int, latitude, longitude float32) *FakeDevice {
+	deviceIdHasher := sha1.New()
+	deviceIdHasher.Write([]byte(fmt.Sprintf("station-%s", name)))
+	deviceID := deviceIdHasher.Sum(nil)
+
+	generationHasher := sha1.New()
+	generationHasher.Write([]byte(fmt.Sprintf("station-%s-generation", name)))
+	generation := generationHasher.Sum(nil)
+
+	state := HardwareState{
+		Recording:   false,
+		StartedTime: 0, // uint64(time.Now().Unix() - 300),
+		Lora: &pb.LoraSettings{
+			DeviceEui: deviceID,
+		},
+		Identity: pb.Identity{
+			DeviceId:     deviceID,
+			GenerationId: generation,
+			Device:       name,
+			Name:         name,
+		},
+		Networks: []*pb.NetworkInfo{
+			&pb.NetworkInfo{
+				Ssid:     "Fake",
+				Password: "Network",
+			},
+		},
+		Streams: [2]*StreamState{
+			&StreamState{
+				Time:    0,
+				Size:    0,
+				Version: 0,
+				Record:  0,
+				File:    env.Path(fmt.Sprintf("%s-data.fkpb", name)),
+			},
+			&StreamState{
+				Time:    0,
+				Size:    0,
+				Version: 0,
+				Record:  0,
+				File:    env.Path(fmt.Sprintf("%s-meta.fkpb", name)),
+			},
+		},
+	}
+
+	now := env.Clock.Now().UTC()
+	random := env.NewRandom(name)
+
+	tlsPort := 0
+	if port > 0 {
+		tlsPort = port + TlsPortOffset
+	}
+
+	stationLatitude := latitude + (random.Float32() * 2.00) - 1.0
+	stationLongitude := longitude + (random.Float32() * 2.00) - 1.0
+
+	log.Printf("Location: %v %v", stationLatitude, stationLongitude)
+
+	fd := &FakeDevice{
+		Name:        name,
+		DeviceId:    hex.EncodeToString(deviceID),
+		Port:        port,
+		TlsPort:     tlsPort,
+		State:       &state,
+		Environment: env,
+		Random:      random,
+		reschedule:  make(chan bool, 1),
+		closed:      make(chan bool),
+		BootTime:    now,
+		Logs:        NewDeviceLog(DeviceLogCapacity),
+		ReadingsSchedule: &pb.Schedule{
+			Interval: 60,
+			Intervals: []*pb.Interval{
+				&pb.Interval{
+					Start:    0,
+					End:      86400,
+					Interval: 60,
+				},
+			},
+		},
+		LoraSchedule: &pb.Schedule{
+			Interval: 300,
+		},
+		NetworkSchedule: &pb.Schedule{
+			Interval: 0,
+		},
+		GpsSchedule: &pb.Schedule{
+			Interval: 86400,
+		},
+		Latitude:     stationLatitude,
+		Longitude:    stationLongitude,
+		HaveLocation: true,
+		GpsModel:     NewGpsModel(DefaultGpsParameters, env.SeedFor(fmt.Sprintf("%s-gps", name))),
+		Enclosure:    NewEnclosureSignal(env.SeedFor(fmt.Sprintf("%s-enclosure", name))),
+		Power: &pb.PowerStatus{
+			Battery: &pb.BatteryStatus{},
+			Solar:   &pb.SolarStatus{},
+		},
+		PowerModel: NewPowerModel(DefaultPowerParameters, 70.0),
+		Firmware: &pb.Firmware{
+			Timestamp: uint64(now.Unix()),
+			Hash:      "hash",
+			Number:    "590",
+			Version:   "1.0.0-main.0-abcdef",
+		},
+		FirmwareSize:   DefaultFirmwareSize,
+		RebootDuration: DefaultRebootDuration,
+		Modules: []*FakeModule{
+			NewFakeModule(env, name, 0, pbatlas.SensorType_SENSOR_PH),
+			NewFakeModule(env, name, 1, pbatlas.SensorType_SENSOR_EC),
+			NewFakeModule(env, name, 2, pbatlas.SensorType_SENSOR_TEMP),
+			NewFakeModule(env, name, 3, pbatlas.SensorType_SENSOR_DO),
+			NewFakeModule(env, name, 4, pbatlas.SensorType_SENSOR_ORP),
+		},
+	}
+
+	fd.updatePower()
+	fd.updateGps()
+	fd.logf("startup", "%s starting, firmware %s", name, fd.Firmware.Version)
+
+	return fd
+}
+
+func CreateFakeDevicesNamed(env *Environment, names []string, noModules bool, basePort int, latitude, longitude float32) []*FakeDevice {
+	devices := make([]*FakeDevice, len(names))
+	for i, name := range names {
+		devices[i] = NewFakeDevice(env, name, PortFor(basePort, i), latitude, longitude)
+
+		if noModules {
+			devices[i].Modules = make([]*FakeModule, 0)
+		}
+	}
+	return devices
+}
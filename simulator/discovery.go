@@ -0,0 +1,393 @@
+package simulator
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/fieldkit/app-protocol"
+)
+
+const (
+	ZeroConfService      = "_fk._tcp"
+	ZeroConfHttpsService = "_fk-https._tcp"
+	ZeroConfTTL          = 10
+)
+
+// ZeroConfOptions configures how stations advertise themselves, a zero TTL is
+// ZeroConfTTL and no interfaces means all of them.
+type ZeroConfOptions struct {
+	TTL        uint32
+	Https      bool
+	Interfaces []string
+}
+
+// ZeroConf is a station's registrations, one per advertised service.
+type ZeroConf struct {
+	servers []*zeroconf.Server
+}
+
+func (zc *ZeroConf) Shutdown() {
+	for _, server := range zc.servers {
+		server.Shutdown()
+	}
+}
+
+func zeroConfInterfaces(names []string) ([]net.Interface, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	ifaces := make([]net.Interface, 0)
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = append(ifaces, *iface)
+	}
+	return ifaces, nil
+}
+
+// zeroConfText describes the station the way the app shows it before
+// connecting, the caller holds the device's lock.
+func zeroConfText(device *FakeDevice, secure bool) []string {
+	text := []string{
+		"name=" + device.State.Identity.Device,
+		"generation=" + hex.EncodeToString(device.State.Identity.GenerationId),
+	}
+	if device.Firmware != nil {
+		text = append(text, "firmware="+device.Firmware.Version)
+	}
+	if secure {
+		text = append(text, "https_port="+strconv.Itoa(device.TlsPort))
+	}
+	return text
+}
+
+// zeroConfRegistration is what a station registers, captured under the
+// device's lock so that registering, which is network I/O, happens outside it.
+type zeroConfRegistration struct {
+	name     string
+	instance string
+	text     []string
+	services map[string]int
+	options  ZeroConfOptions
+}
+
+// newZeroConfRegistration describes the station's services, the caller holds
+// the device's lock.
+func newZeroConfRegistration(device *FakeDevice, secure bool, o ZeroConfOptions) *zeroConfRegistration {
+	services := map[string]int{
+		ZeroConfService: device.Port,
+	}
+	if o.Https && secure {
+		services[ZeroConfHttpsService] = device.TlsPort
+	}
+
+	return &zeroConfRegistration{
+		name:     device.Name,
+		instance: device.DeviceId,
+		text:     zeroConfText(device, secure),
+		services: services,
+		options:  o,
+	}
+}
+
+func (r *zeroConfRegistration) Publish() (*ZeroConf, error) {
+	ifaces, err := zeroConfInterfaces(r.options.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := r.options.TTL
+	if ttl == 0 {
+		ttl = ZeroConfTTL
+	}
+
+	zc := &ZeroConf{}
+
+	for serviceType, port := range r.services {
+		server, err := zeroconf.Register(r.instance, serviceType, "local.", port, r.text, ifaces)
+		if err != nil {
+			zc.Shutdown()
+			return nil, fmt.Errorf("registering %v: %v", serviceType, err)
+		}
+
+		server.TTL(ttl)
+
+		zc.servers = append(zc.servers, server)
+
+		log.Printf("Registered ZeroConf: %v %v %v %v", r.name, serviceType, r.instance, r.text)
+	}
+
+	return zc, nil
+}
+
+// PublishAddressOverZeroConf registers the station's services, the caller
+// holds the device's lock.
+func PublishAddressOverZeroConf(device *FakeDevice, secure bool, o ZeroConfOptions) (*ZeroConf, error) {
+	return newZeroConfRegistration(device, secure, o).Publish()
+}
+
+const (
+	DiscoveryGroup    = "224.1.2.3"
+	DiscoveryPort     = 22143
+	DiscoveryInterval = 2 * time.Second
+)
+
+// DiscoveryOptions configures the UDP announcements, a zero TTL leaves the
+// system default. Announcements go to the multicast group unless Broadcast is
+// set, in which case they go to the broadcast address of each of the chosen
+// addresses' subnets.
+type DiscoveryOptions struct {
+	Group     string
+	Port      int
+	Interval  time.Duration
+	TTL       int
+	Broadcast bool
+	Addresses AddressOptions
+}
+
+type announcement struct {
+	name     string
+	deviceId string
+	port     int
+}
+
+func udpMessage(a announcement, status pb.UdpStatus) ([]byte, error) {
+	deviceId, err := hex.DecodeString(a.deviceId)
+	if err != nil {
+		return nil, err
+	}
+	udp := &pb.UdpMessage{
+		DeviceId: deviceId,
+		Status:   status,
+		Port:     uint32(a.port),
+	}
+	data, err := proto.Marshal(udp)
+	if err != nil {
+		return nil, err
+	}
+	buf := proto.NewBuffer(make([]byte, 0))
+	buf.EncodeRawBytes(data)
+	return buf.Bytes(), nil
+}
+
+func setSocketOption(conn *net.UDPConn, level int, option int, value int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, option, value)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// dialMulticast connects to the group, from the first chosen address of the
+// group's family when an interface is given.
+func dialMulticast(o DiscoveryOptions, group string, port int) ([]*net.UDPConn, error) {
+	ip := net.ParseIP(group)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid multicast group %v", group)
+	}
+
+	network := "udp4"
+	if ip.To4() == nil {
+		network = "udp6"
+	}
+
+	remote := &net.UDPAddr{IP: ip, Port: port}
+
+	var local *net.UDPAddr
+	if o.Addresses.Interface != "" {
+		selection := o.Addresses
+		selection.IPv6 = network == "udp6"
+		addresses, err := LanAddresses(selection)
+		if err != nil {
+			return nil, err
+		}
+		for _, la := range addresses {
+			if la.IsIPv4() == (network == "udp4") {
+				local = &net.UDPAddr{IP: la.IP}
+				if network == "udp6" {
+					local.Zone = la.Interface
+					remote.Zone = la.Interface
+				}
+				break
+			}
+		}
+		if local == nil {
+			return nil, fmt.Errorf("no %v address on %v", network, o.Addresses.Interface)
+		}
+	}
+
+	conn, err := net.DialUDP(network, local, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.TTL > 0 {
+		if network == "udp4" {
+			err = setSocketOption(conn, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, o.TTL)
+		} else {
+			err = setSocketOption(conn, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, o.TTL)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	log.Printf("Publishing UDP on %v", remote)
+
+	return []*net.UDPConn{conn}, nil
+}
+
+// dialBroadcast connects to the broadcast address of every chosen IPv4
+// subnet, IPv6 has no broadcast.
+func dialBroadcast(o DiscoveryOptions, port int) ([]*net.UDPConn, error) {
+	addresses, err := LanAddresses(o.Addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	conns := make([]*net.UDPConn, 0)
+
+	for _, la := range addresses {
+		broadcast, err := la.Broadcast()
+		if err != nil {
+			log.Printf("Skipping %v: %v", la, err)
+			continue
+		}
+
+		remote := &net.UDPAddr{IP: broadcast, Port: port}
+
+		conn, err := net.DialUDP("udp4", &net.UDPAddr{IP: la.IP}, remote)
+		if err == nil {
+			err = setSocketOption(conn, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+
+		log.Printf("Publishing UDP on %v from %v", remote, la)
+
+		conns = append(conns, conn)
+	}
+
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("no addresses to broadcast from")
+	}
+
+	return conns, nil
+}
+
+// PublishDnsDiscovery announces online stations every interval, rebuilding
+// the messages each time so added stations and changed ports are picked up.
+// Stations that go offline or are removed get a single BYE, as do all the
+// announced stations when ctx is done.
+func PublishDnsDiscovery(ctx context.Context, o DiscoveryOptions, stations *Stations) error {
+	group := o.Group
+	if group == "" {
+		group = DiscoveryGroup
+	}
+	port := o.Port
+	if port == 0 {
+		port = DiscoveryPort
+	}
+	interval := o.Interval
+	if interval <= 0 {
+		interval = DiscoveryInterval
+	}
+
+	var conns []*net.UDPConn
+	var err error
+	if o.Broadcast {
+		conns, err = dialBroadcast(o, port)
+	} else {
+		conns, err = dialMulticast(o, group, port)
+	}
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	send := func(a announcement, status pb.UdpStatus) {
+		message, err := udpMessage(a, status)
+		if err != nil {
+			log.Printf("%s: error: %v", a.name, err)
+			return
+		}
+		if status == pb.UdpStatus_UDP_STATUS_BYE {
+			log.Printf("%s: UDP bye", a.name)
+		}
+		for _, conn := range conns {
+			if _, err := conn.Write(message); err != nil {
+				log.Printf("Error: %v", err)
+			}
+		}
+	}
+
+	// Keyed by device id, so renaming a station doesn't say goodbye to it.
+	announced := make(map[string]announcement)
+
+	for {
+		online := make(map[string]bool)
+
+		for _, device := range stations.All() {
+			if !device.IsOnline() {
+				continue
+			}
+
+			device.lock.Lock()
+			a := announcement{name: device.Name, deviceId: device.DeviceId, port: device.Port}
+			device.lock.Unlock()
+
+			online[a.deviceId] = true
+			announced[a.deviceId] = a
+
+			send(a, pb.UdpStatus_UDP_STATUS_ONLINE)
+		}
+
+		for deviceId, a := range announced {
+			if !online[deviceId] {
+				send(a, pb.UdpStatus_UDP_STATUS_BYE)
+				delete(announced, deviceId)
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			for _, a := range announced {
+				send(a, pb.UdpStatus_UDP_STATUS_BYE)
+			}
+			return nil
+		}
+	}
+}
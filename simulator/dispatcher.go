@@ -0,0 +1,43 @@
+package simulator
+
+import (
+	"context"
+
+	pb "github.com/fieldkit/app-protocol"
+)
+
+type ReplyWriter interface {
+	Prepare(size int) error
+	WriteReply(reply *pb.HttpReply) (int, error)
+	WriteBytes(bytes []byte) (int, error)
+}
+
+type ApiHandler func(ctx context.Context, device *FakeDevice, query *pb.HttpQuery, reply ReplyWriter) (err error)
+
+type Dispatcher struct {
+	handlers map[pb.QueryType]ApiHandler
+}
+
+func NewDispatcher() *Dispatcher {
+	handlers := make(map[pb.QueryType]ApiHandler)
+	return &Dispatcher{
+		handlers: handlers,
+	}
+}
+
+func (rd *Dispatcher) AddHandler(qt pb.QueryType, handler ApiHandler) {
+	rd.handlers[qt] = handler
+}
+
+// NewStationDispatcher handles every query the simulated stations support.
+func NewStationDispatcher() *Dispatcher {
+	dispatcher := NewDispatcher()
+	dispatcher.AddHandler(pb.QueryType_QUERY_STATUS, handleQueryReadings)
+	dispatcher.AddHandler(pb.QueryType_QUERY_TAKE_READINGS, handleQueryReadings)
+	dispatcher.AddHandler(pb.QueryType_QUERY_GET_READINGS, handleQueryReadings)
+	dispatcher.AddHandler(pb.QueryType_QUERY_CONFIGURE, handleConfigure)
+	dispatcher.AddHandler(pb.QueryType_QUERY_RECORDING_CONTROL, handleRecordingControl)
+	dispatcher.AddHandler(pb.QueryType_QUERY_SCAN_NETWORKS, handleQueryScanNetworks)
+	dispatcher.AddHandler(pb.QueryType_QUERY_SCAN_MODULES, handleQueryScanModules)
+	return dispatcher
+}
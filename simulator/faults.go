@@ -0,0 +1,371 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/fieldkit/app-protocol"
+)
+
+const (
+	FaultLatency       = "latency"
+	FaultDrop          = "drop"
+	FaultTruncate      = "truncate"
+	FaultContentLength = "content-length"
+	FaultError         = "error"
+	FaultBusy          = "busy"
+	FaultCorrupt       = "corrupt"
+)
+
+var faultKinds = map[string]bool{
+	FaultLatency:       true,
+	FaultDrop:          true,
+	FaultTruncate:      true,
+	FaultContentLength: true,
+	FaultError:         true,
+	FaultBusy:          true,
+	FaultCorrupt:       true,
+}
+
+// FaultRule injects one kind of failure into matching requests. Empty Device,
+// Endpoint and Query fields match everything. A rule fires with the given
+// Probability, where 0 means every time, and a rule with a Count expires once
+// it has fired that many times.
+type FaultRule struct {
+	Device      string  `yaml:"device" json:"device"`
+	Endpoint    string  `yaml:"endpoint" json:"endpoint"`
+	Query       string  `yaml:"query" json:"query"`
+	Kind        string  `yaml:"kind" json:"kind"`
+	Probability float64 `yaml:"probability" json:"probability"`
+	Count       int     `yaml:"count" json:"count"`
+	Latency     int     `yaml:"latency_ms" json:"latency_ms"`
+	Status      int     `yaml:"status" json:"status"`
+	Delay       uint32  `yaml:"delay" json:"delay"`
+	fired       int
+}
+
+// FaultRuleStatus is a rule along with the number of times it has fired.
+type FaultRuleStatus struct {
+	FaultRule
+	Fired int `json:"fired"`
+}
+
+type FaultRules struct {
+	Rules []*FaultRule `yaml:"rules" json:"rules"`
+}
+
+func (r *FaultRule) Validate() error {
+	if !faultKinds[r.Kind] {
+		return fmt.Errorf("kind: unknown fault %q", r.Kind)
+	}
+	if r.Query != "" {
+		if _, ok := pb.QueryType_value[r.Query]; !ok {
+			return fmt.Errorf("query: unknown query type %q", r.Query)
+		}
+	}
+	if r.Probability < 0 || r.Probability > 1 {
+		return fmt.Errorf("probability: %v is out of range (0-1)", r.Probability)
+	}
+	if r.Count < 0 {
+		return fmt.Errorf("count: %d is negative", r.Count)
+	}
+	return nil
+}
+
+func (r *FaultRule) matches(device string, endpoint string, query string) bool {
+	if r.Device != "" && r.Device != device {
+		return false
+	}
+	if r.Endpoint != "" && !strings.HasPrefix(endpoint, r.Endpoint) {
+		return false
+	}
+	if r.Query != "" && r.Query != query {
+		return false
+	}
+	if r.Count > 0 && r.fired >= r.Count {
+		return false
+	}
+	return true
+}
+
+type FaultInjector struct {
+	lock   sync.Mutex
+	rules  []*FaultRule
+	random *rand.Rand
+}
+
+func NewFaultInjector(random *rand.Rand) *FaultInjector {
+	return &FaultInjector{
+		rules:  make([]*FaultRule, 0),
+		random: random,
+	}
+}
+
+func LoadFaultRules(path string) ([]*FaultRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading faults: %v", err)
+	}
+
+	rules := &FaultRules{}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = unmarshalJsonStrict(data, rules)
+	default:
+		err = yaml.UnmarshalStrict(data, rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing faults %s: %v", path, err)
+	}
+
+	for i, rule := range rules.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid faults %s: rules[%d].%v", path, i, err)
+		}
+	}
+
+	return rules.Rules, nil
+}
+
+// SetRules replaces every rule, resetting their counts.
+func (fi *FaultInjector) SetRules(rules []*FaultRule) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	for _, rule := range rules {
+		rule.fired = 0
+	}
+	fi.rules = rules
+	log.Printf("Faults: %d rules", len(rules))
+}
+
+func (fi *FaultInjector) AddRule(rule *FaultRule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	rule.fired = 0
+	fi.rules = append(fi.rules, rule)
+	return nil
+}
+
+func (fi *FaultInjector) Rules() []FaultRuleStatus {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	rules := make([]FaultRuleStatus, 0)
+	for _, rule := range fi.rules {
+		rules = append(rules, FaultRuleStatus{
+			FaultRule: *rule,
+			Fired:     rule.fired,
+		})
+	}
+	return rules
+}
+
+// Fire returns the rules that trigger for a request, counting them as fired.
+func (fi *FaultInjector) Fire(device string, endpoint string, query string) []*FaultRule {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+
+	fired := make([]*FaultRule, 0)
+	for _, rule := range fi.rules {
+		if !rule.matches(device, endpoint, query) {
+			continue
+		}
+		if rule.Probability > 0 && fi.random.Float64() >= rule.Probability {
+			continue
+		}
+		rule.fired += 1
+		fired = append(fired, rule)
+		log.Printf("%s: fault %s (%s %s)", device, rule.Kind, endpoint, query)
+	}
+	return fired
+}
+
+// Peeks at the body of a protocol request to find the query type, leaving the
+// body intact for the real handler. An empty body is a status query.
+func peekQueryType(req *http.Request) string {
+	if req.Body == nil {
+		return pb.QueryType_QUERY_STATUS.String()
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return ""
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if len(body) == 0 {
+		return pb.QueryType_QUERY_STATUS.String()
+	}
+
+	if req.Header.Get("Content-Type") == "text/plain" {
+		decoded, err := hex.DecodeString(string(body))
+		if err != nil {
+			return ""
+		}
+		body = decoded
+	}
+
+	size, n := proto.DecodeVarint(body)
+	if n == 0 || uint64(len(body)-n) < size {
+		return ""
+	}
+
+	query := &pb.HttpQuery{}
+	if err := proto.Unmarshal(body[n:n+int(size)], query); err != nil {
+		return ""
+	}
+
+	return query.Type.String()
+}
+
+type faultRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (fr *faultRecorder) Header() http.Header {
+	return fr.header
+}
+
+func (fr *faultRecorder) WriteHeader(status int) {
+	if fr.status == 0 {
+		fr.status = status
+	}
+}
+
+func (fr *faultRecorder) Write(data []byte) (int, error) {
+	if fr.status == 0 {
+		fr.status = http.StatusOK
+	}
+	return fr.body.Write(data)
+}
+
+func (fi *FaultInjector) Middleware(device *FakeDevice, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := ""
+		if req.URL.Path == "/fk/v1" {
+			query = peekQueryType(req)
+		}
+
+		rules := fi.Fire(device.Name, req.URL.Path, query)
+		if len(rules) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		target := req.URL.Path
+		if query != "" {
+			target = query
+		}
+		device.lock.Lock()
+		for _, rule := range rules {
+			device.logf("faults", "%s injected on %s", rule.Kind, target)
+		}
+		device.lock.Unlock()
+
+		transforms := make([]*FaultRule, 0)
+
+		for _, rule := range rules {
+			switch rule.Kind {
+			case FaultLatency:
+				// Clients time out by the wall clock, whatever the simulated
+				// one is doing.
+				time.Sleep(time.Duration(rule.Latency) * time.Millisecond)
+			case FaultError:
+				status := rule.Status
+				if status == 0 {
+					status = http.StatusInternalServerError
+				}
+				http.Error(w, "fault injected", status)
+				return
+			case FaultBusy:
+				rw := &HttpReplyWriter{
+					hexEncoding: req.Header.Get("Content-Type") == "text/plain",
+					res:         w,
+				}
+				rw.WriteReply(makeBusyReply(rule.Delay))
+				return
+			default:
+				transforms = append(transforms, rule)
+			}
+		}
+
+		if len(transforms) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		recorder := &faultRecorder{
+			header: make(http.Header),
+		}
+
+		next.ServeHTTP(recorder, req)
+
+		body := recorder.body.Bytes()
+		contentLength := len(body)
+		drop := false
+
+		for _, rule := range transforms {
+			switch rule.Kind {
+			case FaultTruncate:
+				body = body[:len(body)/2]
+				contentLength = len(body)
+			case FaultCorrupt:
+				corrupted := make([]byte, len(body))
+				copy(corrupted, body)
+				for i := 0; i < len(corrupted)/64+1 && len(corrupted) > 0; i += 1 {
+					corrupted[fi.randomIntn(len(corrupted))] ^= 0xff
+				}
+				body = corrupted
+			case FaultContentLength:
+				contentLength = len(body) + 1 + fi.randomIntn(1024)
+			case FaultDrop:
+				drop = true
+			}
+		}
+
+		for key, values := range recorder.header {
+			w.Header()[key] = values
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", contentLength))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		w.WriteHeader(recorder.status)
+
+		if drop {
+			w.Write(body[:len(body)/2])
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			// Closes the connection without a complete response.
+			panic(http.ErrAbortHandler)
+		}
+
+		w.Write(body)
+	})
+}
+
+func (fi *FaultInjector) randomIntn(n int) int {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	return fi.random.Intn(n)
+}
@@ -0,0 +1,271 @@
+package simulator
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/fieldkit/app-protocol"
+)
+
+const (
+	FirmwareFailureNone        = ""
+	FirmwareFailureBadHash     = "bad-hash"
+	FirmwareFailureInterrupted = "interrupted"
+
+	DefaultRebootDuration = 10 * time.Second
+	DefaultFirmwareSize   = 424 * 1024
+
+	// Gives the reply to an upload time to reach the client before the
+	// servers go away.
+	RebootFlushDelay = 250 * time.Millisecond
+
+	// Images from the firmware's build carry a header, marked by this
+	// signature, somewhere in their first few kilobytes.
+	FirmwareHeaderSignature = "FKB\x00"
+	FirmwareHeaderSearch    = 4096
+	FirmwareHeaderNameMax   = 256
+)
+
+var firmwareFailures = map[string]bool{
+	FirmwareFailureNone:        true,
+	FirmwareFailureBadHash:     true,
+	FirmwareFailureInterrupted: true,
+}
+
+func ValidateFirmwareFailure(failure string) error {
+	if !firmwareFailures[failure] {
+		return fmt.Errorf("unknown firmware failure %q", failure)
+	}
+	return nil
+}
+
+// FirmwareHeader is the start of the header the firmware's build places in
+// its images, little endian like the hardware. The version is in Name.
+type FirmwareHeader struct {
+	Signature     [4]byte
+	HeaderVersion uint32
+	HeaderSize    uint32
+	Flags         uint32
+	Timestamp     uint32
+	Number        uint32
+	Reserved      [4]uint32
+	Safe          uint32
+	Previous      uint32
+	BinarySize    uint32
+	TablesOffset  uint32
+	DataSize      uint32
+	BssSize       uint32
+	GotSize       uint32
+	VtorOffset    uint32
+	GotOffset     uint32
+	Name          [FirmwareHeaderNameMax]byte
+}
+
+func (fh *FirmwareHeader) Version() string {
+	name := fh.Name[:]
+	if end := bytes.IndexByte(name, 0); end >= 0 {
+		name = name[:end]
+	}
+	return string(name)
+}
+
+// ParseFirmwareHeader finds the header in an image, returning nil when there
+// isn't one.
+func ParseFirmwareHeader(image []byte) (*FirmwareHeader, error) {
+	search := image
+	if len(search) > FirmwareHeaderSearch {
+		search = search[:FirmwareHeaderSearch]
+	}
+
+	offset := bytes.Index(search, []byte(FirmwareHeaderSignature))
+	if offset < 0 {
+		return nil, nil
+	}
+
+	header := &FirmwareHeader{}
+	if err := binary.Read(bytes.NewReader(image[offset:]), binary.LittleEndian, header); err != nil {
+		return nil, fmt.Errorf("header at %d is truncated", offset)
+	}
+
+	return header, nil
+}
+
+// FirmwareUpload is an image received from the app. The version, build number
+// and timestamp come from the image's header, and the Fk-Firmware-Version,
+// Number and Timestamp headers override them when they're given.
+// Fk-Firmware-Hash is the hex SHA-1 of the image and is checked when present.
+type FirmwareUpload struct {
+	Image     []byte
+	Header    *FirmwareHeader
+	Hash      string
+	Version   string
+	Number    string
+	Timestamp uint64
+}
+
+func (fu *FirmwareUpload) File(device *FakeDevice) string {
+	return device.Environment.Path(fmt.Sprintf("%s-firmware.bin", device.Name))
+}
+
+// readFirmwareUpload reads the image, failure is the station's FirmwareFailure
+// as it was when the upload started.
+func readFirmwareUpload(req *http.Request, failure string) (*FirmwareUpload, error) {
+	var reader io.Reader = req.Body
+	if failure == FirmwareFailureInterrupted && req.ContentLength > 0 {
+		reader = io.LimitReader(req.Body, req.ContentLength/2)
+	}
+
+	image, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("reading image: %v", err)
+	}
+
+	upload := &FirmwareUpload{
+		Image:   image,
+		Version: req.Header.Get("Fk-Firmware-Version"),
+		Number:  req.Header.Get("Fk-Firmware-Number"),
+	}
+
+	if value := req.Header.Get("Fk-Firmware-Timestamp"); value != "" {
+		timestamp, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", value)
+		}
+		upload.Timestamp = timestamp
+	}
+
+	hasher := sha1.New()
+	hasher.Write(image)
+	upload.Hash = hex.EncodeToString(hasher.Sum(nil))
+
+	return upload, nil
+}
+
+func (fu *FirmwareUpload) Verify(req *http.Request, failure string) error {
+	if req.ContentLength >= 0 && int64(len(fu.Image)) != req.ContentLength {
+		return fmt.Errorf("size mismatch, expected %d got %d", req.ContentLength, len(fu.Image))
+	}
+
+	expected := strings.ToLower(req.Header.Get("Fk-Firmware-Hash"))
+	if failure == FirmwareFailureBadHash {
+		expected = strings.Repeat("0", sha1.Size*2)
+	}
+	if expected != "" && expected != fu.Hash {
+		return fmt.Errorf("hash mismatch, expected %s got %s", expected, fu.Hash)
+	}
+
+	header, err := ParseFirmwareHeader(fu.Image)
+	if err != nil {
+		return err
+	}
+	fu.Header = header
+
+	return nil
+}
+
+func (fu *FirmwareUpload) Apply(device *FakeDevice) {
+	firmware := &pb.Firmware{
+		Version:   device.Firmware.Version,
+		Number:    device.Firmware.Number,
+		Hash:      fu.Hash,
+		Timestamp: uint64(device.Now().Unix()),
+	}
+	if fu.Header != nil {
+		firmware.Version = fu.Header.Version()
+		firmware.Number = fmt.Sprintf("%d", fu.Header.Number)
+		firmware.Timestamp = uint64(fu.Header.Timestamp)
+	}
+	if fu.Version != "" {
+		firmware.Version = fu.Version
+	}
+	if fu.Number != "" {
+		firmware.Number = fu.Number
+	}
+	if fu.Timestamp > 0 {
+		firmware.Timestamp = fu.Timestamp
+	}
+
+	device.Firmware = firmware
+	if size := uint32(len(fu.Image)); size > 0 && size < ProgramFlashSize {
+		device.FirmwareSize = size
+	}
+	device.logf("upgrade", "firmware %s #%s (%s) received, %d bytes", firmware.Version, firmware.Number, firmware.Hash, len(fu.Image))
+
+	log.Printf("%s firmware %s #%s (%s)", device.Name, firmware.Version, firmware.Number, firmware.Hash)
+}
+
+// Reboot takes the station off the network for RebootDuration, as the real
+// hardware does after an upgrade, and then announces it again. It returns
+// straight away, a closed station isn't rebooted and Close waits for a reboot
+// in progress. The caller doesn't hold the lock.
+func (fd *FakeDevice) Reboot() {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+
+	if fd.isClosed() || fd.rebooting {
+		return
+	}
+
+	fd.rebooting = true
+	fd.reboots.Add(1)
+
+	go fd.reboot()
+}
+
+// reboot takes no readings while the station is down, like a brown out.
+func (fd *FakeDevice) reboot() {
+	defer fd.reboots.Done()
+
+	select {
+	case <-time.After(RebootFlushDelay):
+	case <-fd.closed:
+		return
+	}
+
+	fd.lock.Lock()
+	duration := fd.RebootDuration
+	dispatcher := fd.dispatcher
+	fd.logf("startup", "rebooting")
+	fd.lock.Unlock()
+
+	log.Printf("%s rebooting (%v)", fd.Name, duration)
+
+	fd.Stop()
+
+	timer := fd.Environment.Clock.NewTimer(duration)
+	select {
+	case <-timer.C:
+	case <-fd.closed:
+		timer.Stop()
+		return
+	}
+
+	fd.lock.Lock()
+	if fd.isClosed() {
+		fd.lock.Unlock()
+		return
+	}
+	fd.rebooting = false
+	fd.BootTime = fd.Now()
+	fd.GpsModel.ColdStart(fd.BootTime)
+	fd.logf("startup", "%s starting, firmware %s", fd.Name, fd.Firmware.Version)
+	fd.ScanModules()
+	fd.lock.Unlock()
+
+	if err := fd.Start(dispatcher); err != nil {
+		log.Printf("%s: error rebooting: %v", fd.Name, err)
+		return
+	}
+
+	log.Printf("%s rebooted", fd.Name)
+}
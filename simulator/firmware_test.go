@@ -0,0 +1,135 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// firmwareImage is an image with a header after some vector table sized
+// padding, as the firmware's build lays them out.
+func firmwareImage(t *testing.T, version string, number, timestamp uint32) []byte {
+	header := FirmwareHeader{
+		HeaderVersion: 1,
+		Timestamp:     timestamp,
+		Number:        number,
+	}
+	copy(header.Signature[:], FirmwareHeaderSignature)
+	copy(header.Name[:], version)
+
+	image := &bytes.Buffer{}
+	image.Write(make([]byte, 0x100))
+	if err := binary.Write(image, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	image.Write(make([]byte, 2048))
+	return image.Bytes()
+}
+
+func TestFirmwareUpload(t *testing.T) {
+	image := firmwareImage(t, "1.2.3-feature", 412, 1600000000)
+
+	cases := []struct {
+		name      string
+		image     []byte
+		headers   map[string]string
+		version   string
+		number    string
+		timestamp uint64
+		rejected  bool
+	}{
+		{
+			name:      "from the image",
+			image:     image,
+			version:   "1.2.3-feature",
+			number:    "412",
+			timestamp: 1600000000,
+		},
+		{
+			name:  "overridden",
+			image: image,
+			headers: map[string]string{
+				"Fk-Firmware-Version":   "2.0.0",
+				"Fk-Firmware-Number":    "500",
+				"Fk-Firmware-Timestamp": "1700000000",
+			},
+			version:   "2.0.0",
+			number:    "500",
+			timestamp: 1700000000,
+		},
+		{
+			name:  "partly overridden",
+			image: image,
+			headers: map[string]string{
+				"Fk-Firmware-Number": "413",
+			},
+			version:   "1.2.3-feature",
+			number:    "413",
+			timestamp: 1600000000,
+		},
+		{
+			name:  "without a header",
+			image: make([]byte, 1024),
+			headers: map[string]string{
+				"Fk-Firmware-Version": "3.0.0",
+			},
+			version: "3.0.0",
+			number:  "1",
+		},
+		{
+			name:     "truncated header",
+			image:    image[:0x100+64],
+			rejected: true,
+		},
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	env := NewEnvironment(1, NewScaledClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 1))
+	env.Directory = dir
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			device := NewFakeDevice(env, "firmware", 0, 0, 0)
+			device.Firmware.Number = "1"
+
+			req := httptest.NewRequest("POST", "/fk/v1/upload/firmware", bytes.NewReader(c.image))
+			for key, value := range c.headers {
+				req.Header.Set(key, value)
+			}
+
+			upload, err := readFirmwareUpload(req, FirmwareFailureNone)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = upload.Verify(req, FirmwareFailureNone)
+			if c.rejected {
+				if err == nil {
+					t.Fatalf("expected the upload to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			upload.Apply(device)
+
+			firmware := device.Firmware
+			if firmware.Version != c.version || firmware.Number != c.number {
+				t.Errorf("expected %s #%s, got %s #%s", c.version, c.number, firmware.Version, firmware.Number)
+			}
+			if c.timestamp > 0 && firmware.Timestamp != c.timestamp {
+				t.Errorf("expected timestamp %d, got %d", c.timestamp, firmware.Timestamp)
+			}
+			if firmware.Hash != upload.Hash {
+				t.Errorf("expected hash %s, got %s", upload.Hash, firmware.Hash)
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package simulator
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"time"
+
+	pb "github.com/fieldkit/app-protocol"
+)
+
+const (
+	MinimumSatellites = 4
+	GpsJitter         = 0.00002
+	EarthRadius       = 6371000.0
+)
+
+// GpsParameters describes a station's GPS receiver. Times are in seconds and
+// FixLossChance is the chance of losing the fix in any minute. With a GPX
+// Track the station moves along it, by the track's own times or at Speed in
+// m/s when it has none, and starts over from the beginning at the end.
+type GpsParameters struct {
+	TimeToFix     float64 `yaml:"time_to_fix" json:"time_to_fix"`
+	TimeToRefix   float64 `yaml:"time_to_refix" json:"time_to_refix"`
+	Satellites    uint32  `yaml:"satellites" json:"satellites"`
+	FixLossChance float64 `yaml:"fix_loss_chance" json:"fix_loss_chance"`
+	Altitude      float64 `yaml:"altitude" json:"altitude"`
+	Track         string  `yaml:"track" json:"track"`
+	Speed         float64 `yaml:"speed" json:"speed"`
+	track         *Track
+}
+
+var DefaultGpsParameters = GpsParameters{
+	TimeToFix:     45,
+	TimeToRefix:   5,
+	Satellites:    8,
+	FixLossChance: 0.002,
+	Altitude:      100,
+	Speed:         1.4,
+}
+
+// Parameters that are left out keep their defaults.
+func (p *GpsParameters) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain GpsParameters
+	*p = DefaultGpsParameters
+	return unmarshal((*plain)(p))
+}
+
+func (p *GpsParameters) UnmarshalJSON(data []byte) error {
+	type plain GpsParameters
+	*p = DefaultGpsParameters
+	return unmarshalJsonStrict(data, (*plain)(p))
+}
+
+// Validate also loads the track, so a bad file is found with the profile.
+func (p *GpsParameters) Validate() error {
+	if p.TimeToFix < 0 {
+		return fmt.Errorf("time_to_fix: %v is negative", p.TimeToFix)
+	}
+	if p.TimeToRefix < 0 {
+		return fmt.Errorf("time_to_refix: %v is negative", p.TimeToRefix)
+	}
+	if p.Satellites < MinimumSatellites {
+		return fmt.Errorf("satellites: %d should be at least %d", p.Satellites, MinimumSatellites)
+	}
+	if p.FixLossChance < 0 || p.FixLossChance > 1 {
+		return fmt.Errorf("fix_loss_chance: %v is out of range", p.FixLossChance)
+	}
+	if p.Track != "" {
+		if p.Speed <= 0 {
+			return fmt.Errorf("speed: %v should be positive", p.Speed)
+		}
+		track, err := LoadTrack(p.Track, p.Speed)
+		if err != nil {
+			return fmt.Errorf("track: %v", err)
+		}
+		p.track = track
+	}
+	return nil
+}
+
+type TrackPoint struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+	Offset    time.Duration
+}
+
+// Track is a path with the time each point is reached, from the start.
+type Track struct {
+	Points    []TrackPoint
+	Altitudes bool
+}
+
+type gpxPoint struct {
+	Latitude  float64  `xml:"lat,attr"`
+	Longitude float64  `xml:"lon,attr"`
+	Elevation *float64 `xml:"ele"`
+	Time      string   `xml:"time"`
+}
+
+type gpxFile struct {
+	Track []gpxPoint `xml:"trk>trkseg>trkpt"`
+	Route []gpxPoint `xml:"rte>rtept"`
+}
+
+func distance(a, b TrackPoint) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dlat := lat2 - lat1
+	dlon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Pow(math.Sin(dlat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dlon/2), 2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(h))
+}
+
+// LoadTrack reads the track points of a GPX file, or its route points when
+// there's no track. Points are timed by their own times when they all have
+// one, otherwise by walking between them at speed.
+func LoadTrack(path string, speed float64) (*Track, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	gpx := &gpxFile{}
+	if err := xml.Unmarshal(data, gpx); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	points := gpx.Track
+	if len(points) == 0 {
+		points = gpx.Route
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("%s has %d points, expected at least 2", path, len(points))
+	}
+
+	track := &Track{
+		Points:    make([]TrackPoint, len(points)),
+		Altitudes: true,
+	}
+
+	timed := true
+	times := make([]time.Time, len(points))
+	for i, gp := range points {
+		if gp.Latitude < -90 || gp.Latitude > 90 || gp.Longitude < -180 || gp.Longitude > 180 {
+			return nil, fmt.Errorf("%s: point %d is out of range", path, i)
+		}
+		track.Points[i] = TrackPoint{
+			Latitude:  gp.Latitude,
+			Longitude: gp.Longitude,
+		}
+		if gp.Elevation != nil {
+			track.Points[i].Altitude = *gp.Elevation
+		} else {
+			track.Altitudes = false
+		}
+		if t, err := time.Parse(time.RFC3339, gp.Time); err == nil {
+			times[i] = t
+		} else {
+			timed = false
+		}
+	}
+
+	for i := 1; i < len(track.Points); i += 1 {
+		if timed {
+			if times[i].Before(times[i-1]) {
+				return nil, fmt.Errorf("%s: point %d is earlier than the one before", path, i)
+			}
+			track.Points[i].Offset = times[i].Sub(times[0])
+		} else {
+			walk := distance(track.Points[i-1], track.Points[i]) / speed
+			track.Points[i].Offset = track.Points[i-1].Offset + time.Duration(walk*float64(time.Second))
+		}
+	}
+
+	if track.Duration() <= 0 {
+		return nil, fmt.Errorf("%s never goes anywhere", path)
+	}
+
+	return track, nil
+}
+
+func (t *Track) Duration() time.Duration {
+	return t.Points[len(t.Points)-1].Offset
+}
+
+// At interpolates the position elapsed after the start, going around again
+// once the end is reached.
+func (t *Track) At(elapsed time.Duration) TrackPoint {
+	elapsed = elapsed % t.Duration()
+	if elapsed < 0 {
+		elapsed += t.Duration()
+	}
+
+	for i := 1; i < len(t.Points); i += 1 {
+		low, high := t.Points[i-1], t.Points[i]
+		if elapsed <= high.Offset {
+			f := 0.0
+			if high.Offset > low.Offset {
+				f = float64(elapsed-low.Offset) / float64(high.Offset-low.Offset)
+			}
+			return TrackPoint{
+				Latitude:  low.Latitude + f*(high.Latitude-low.Latitude),
+				Longitude: low.Longitude + f*(high.Longitude-low.Longitude),
+				Altitude:  low.Altitude + f*(high.Altitude-low.Altitude),
+				Offset:    elapsed,
+			}
+		}
+	}
+
+	return t.Points[len(t.Points)-1]
+}
+
+// GpsModel acquires a fix some time after a cold start, loses it now and
+// then and gets it back again, and moves the station along its track. In
+// fixed mode, as after the app sends its location, the station reports that
+// location instead.
+type GpsModel struct {
+	params     GpsParameters
+	rng        *rand.Rand
+	fix        bool
+	acquiring  time.Time
+	satellites uint32
+	jitter     [3]float64
+	fixed      bool
+	pinned     *bool
+	started    time.Time
+	booted     time.Time
+	last       time.Time
+}
+
+func NewGpsModel(params GpsParameters, seed int64) *GpsModel {
+	return &GpsModel{
+		params: params,
+		rng:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// ColdStart loses the fix, as when the station boots.
+func (gm *GpsModel) ColdStart(now time.Time) {
+	gm.fix = false
+	gm.acquiring = now.Add(seconds(gm.params.TimeToFix))
+	gm.satellites = 0
+	gm.pinned = nil
+	gm.booted = now
+	gm.last = now
+	if gm.started.IsZero() {
+		gm.started = now
+	}
+}
+
+// Advance runs the receiver up to now, a minute at a time unless that's more
+// than MaximumSimulationSteps.
+func (gm *GpsModel) Advance(now time.Time) {
+	if gm.last.IsZero() {
+		gm.ColdStart(now)
+	}
+
+	step := time.Minute
+	if elapsed := now.Sub(gm.last); elapsed > MaximumSimulationSteps*time.Minute {
+		step = elapsed / MaximumSimulationSteps
+	}
+
+	for gm.last.Before(now) {
+		if remaining := now.Sub(gm.last); remaining < step {
+			step = remaining
+		}
+		gm.last = gm.last.Add(step)
+
+		if !gm.fix {
+			if gm.last.Before(gm.acquiring) {
+				gm.satellites = uint32(gm.rng.Intn(MinimumSatellites))
+				continue
+			}
+			gm.fix = true
+			gm.satellites = gm.params.Satellites
+		} else if gm.rng.Float64() < gm.params.FixLossChance*step.Minutes() {
+			gm.fix = false
+			gm.acquiring = gm.last.Add(seconds(gm.params.TimeToRefix))
+			continue
+		}
+
+		satellites := int(gm.satellites) + gm.rng.Intn(3) - 1
+		if satellites >= MinimumSatellites && satellites <= int(gm.params.Satellites)+2 {
+			gm.satellites = uint32(satellites)
+		}
+		gm.jitter = [3]float64{
+			(gm.rng.Float64()*2 - 1) * GpsJitter,
+			(gm.rng.Float64()*2 - 1) * GpsJitter,
+			(gm.rng.Float64()*2 - 1) * 2,
+		}
+	}
+}
+
+func (gm *GpsModel) HasFix() bool {
+	if gm.pinned != nil {
+		return *gm.pinned
+	}
+	return gm.fix || gm.fixed
+}
+
+// StatusAt is the fix and number of satellites at a time up to the last
+// Advance. Before the last cold start, as with primed history, the station is
+// taken to have had a fix, after it the receiver's current state is used.
+func (gm *GpsModel) StatusAt(t time.Time) (bool, uint32) {
+	if t.Before(gm.booted) && gm.pinned == nil {
+		return true, gm.params.Satellites
+	}
+	return gm.HasFix(), gm.satellites
+}
+
+// PinFix holds the fix as it is, until the next cold start.
+func (gm *GpsModel) PinFix(fix bool) {
+	gm.pinned = &fix
+}
+
+func (gm *GpsModel) Satellites() uint32 {
+	return gm.satellites
+}
+
+func (gm *GpsModel) SetSatellites(satellites uint32) {
+	gm.satellites = satellites
+}
+
+func (gm *GpsModel) Fixed() bool {
+	return gm.fixed
+}
+
+func (gm *GpsModel) SetFixed(fixed bool) {
+	gm.fixed = fixed
+}
+
+// Position is where the receiver is at now, given the station's location.
+func (gm *GpsModel) Position(now time.Time, latitude, longitude float32) (float32, float32, float32) {
+	if gm.fixed {
+		return latitude, longitude, float32(gm.params.Altitude)
+	}
+
+	lat, lon, alt := float64(latitude), float64(longitude), gm.params.Altitude
+	if gm.params.track != nil {
+		p := gm.params.track.At(now.Sub(gm.started))
+		lat, lon = p.Latitude, p.Longitude
+		if gm.params.track.Altitudes {
+			alt = p.Altitude
+		}
+	}
+
+	return float32(lat + gm.jitter[0]), float32(lon + gm.jitter[1]), float32(alt + gm.jitter[2])
+}
+
+// updateGps brings the reported GPS status up to date, the caller holds the
+// lock.
+func (fd *FakeDevice) updateGps() {
+	now := fd.Now()
+	fd.GpsModel.Advance(now)
+
+	fd.Gps = &pb.GpsStatus{
+		Enabled:    1,
+		Time:       uint64(now.Unix()),
+		Satellites: fd.GpsModel.Satellites(),
+	}
+	if fd.GpsModel.HasFix() {
+		fd.Gps.Fix = 1
+		fd.Gps.Latitude, fd.Gps.Longitude, fd.Gps.Altitude = fd.GpsModel.Position(now, fd.Latitude, fd.Longitude)
+	}
+}
+
+// Locate takes the location the app sends when the station has none of its
+// own, putting the receiver in fixed mode there as the firmware does. The app
+// sends it with every poll, so nothing is logged or saved unless it changes.
+// The caller holds the lock.
+func (fd *FakeDevice) Locate(latitude, longitude float32) {
+	if fd.HaveLocation {
+		return
+	}
+	if fd.GpsModel.Fixed() && fd.Latitude == latitude && fd.Longitude == longitude {
+		return
+	}
+
+	fd.Latitude = latitude
+	fd.Longitude = longitude
+	fd.GpsModel.SetFixed(true)
+	fd.updateGps()
+	fd.logf("gps", "fixed location %v, %v", latitude, longitude)
+	fd.SaveState()
+}
@@ -0,0 +1,307 @@
+package simulator
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/fieldkit/app-protocol"
+	_ "github.com/fieldkit/data-protocol"
+)
+
+const (
+	SramSize          = 256 * 1024
+	SramFirmwareUsage = 96 * 1024
+	SramModuleUsage   = 4 * 1024
+	SramRequestUsage  = 12 * 1024
+	ProgramFlashSize  = 1024 * 1024
+)
+
+// generateModuleId gives each module its own id, modules attached after the
+// station started have a generation so replacements get fresh ids.
+func generateModuleId(position int, generation uint32, device *FakeDevice, m *pb.ModuleCapabilities) *pb.ModuleCapabilities {
+	hasher := sha1.New()
+	hasher.Write([]byte(device.Name))
+	hasher.Write([]byte(m.Name))
+	hasher.Write([]byte(fmt.Sprintf("%d", position)))
+	if generation > 0 {
+		hasher.Write([]byte(fmt.Sprintf("-%d", generation)))
+	}
+	moduleID := hasher.Sum(nil)
+	m.Id = moduleID
+	return m
+}
+
+// sramAvailable is what's left after the firmware, the modules, requests in
+// progress and the log buffer, give or take what the tasks happen to be using.
+func sramAvailable(device *FakeDevice, now time.Time) uint32 {
+	used := SramFirmwareUsage
+	used += SramModuleUsage * len(device.Modules)
+	used += SramRequestUsage * int(atomic.LoadInt32(&device.requests))
+	used += device.Logs.Size() / 4
+	used += device.randomAt("sram", now).Intn(2 * 1024)
+	if used > SramSize {
+		return 0
+	}
+	return uint32(SramSize - used)
+}
+
+// Replies are built while holding the device's lock and are a copy of its
+// state, so they can be written after the lock is released.
+func makeStatusReply(device *FakeDevice) *pb.HttpReply {
+	device.updatePower()
+	device.updateGps()
+	data := device.State.Streams[0].Status()
+	meta := device.State.Streams[1].Status()
+	used := uint32(data.Size + meta.Size)
+	installed := uint32(512 * 1024 * 1024)
+
+	recording := 0
+	if device.State.Recording {
+		recording = 1
+	}
+
+	reply := &pb.HttpReply{
+		Type: pb.ReplyType_REPLY_STATUS,
+		Status: &pb.Status{
+			Version:  1,
+			Uptime:   device.Uptime(),
+			Identity: &device.State.Identity,
+			Recording: &pb.Recording{
+				Enabled:     recording > 0,
+				StartedTime: device.State.StartedTime,
+			},
+			Memory: &pb.MemoryStatus{
+				SramAvailable:           sramAvailable(device, device.Now()),
+				ProgramFlashAvailable:   ProgramFlashSize - device.FirmwareSize,
+				ExtendedMemoryAvailable: 0,
+				DataMemoryInstalled:     installed,
+				DataMemoryUsed:          used,
+				DataMemoryConsumption:   float32(used) / float32(installed) * 100.0,
+			},
+			Gps:      device.Gps,
+			Power:    device.Power,
+			Logs:     device.Logs.Tail(StatusLogLength),
+			Firmware: device.Firmware,
+		},
+		LoraSettings: device.State.Lora,
+		NetworkSettings: &pb.NetworkSettings{
+			Networks: device.State.Networks,
+		},
+		Modules: makeModules(device),
+		Streams: []*pb.DataStream{
+			&pb.DataStream{
+				Id:      0,
+				Time:    data.Time,
+				Size:    data.Size,
+				Version: data.Version,
+				Block:   data.Record,
+				Name:    "data.fkpb",
+				Path:    "/fk/v1/download/data",
+			},
+			&pb.DataStream{
+				Id:      1,
+				Time:    meta.Time,
+				Size:    meta.Size,
+				Version: meta.Version,
+				Block:   meta.Record,
+				Name:    "meta.fkpb",
+				Path:    "/fk/v1/download/meta",
+			},
+		},
+		Schedules: &pb.Schedules{
+			Readings: device.ReadingsSchedule,
+			Lora:     device.LoraSchedule,
+			Network:  device.NetworkSchedule,
+			Gps:      device.GpsSchedule,
+		},
+	}
+
+	return proto.Clone(reply).(*pb.HttpReply)
+}
+
+func handleQueryScanNetworks(ctx context.Context, device *FakeDevice, query *pb.HttpQuery, rw ReplyWriter) (err error) {
+	reply := &pb.HttpReply{
+		Type: pb.ReplyType_REPLY_SUCCESS,
+		NearbyNetworks: &pb.NearbyNetworks{
+			Networks: []*pb.NearbyNetwork{
+				&pb.NearbyNetwork{
+					Ssid: "Cottonwood",
+				},
+				&pb.NearbyNetwork{
+					Ssid: "Conservify",
+				},
+			},
+		},
+	}
+	_, err = rw.WriteReply(reply)
+	return
+}
+
+func makeLiveReadingsReply(device *FakeDevice) *pb.HttpReply {
+	status := makeStatusReply(device)
+
+	now := device.Now()
+	// ph := rand.Float32() * 7
+	// conductivity := rand.Float32() * 100
+	// dissolvedOxygen := rand.Float32() * 10
+	// temperature := rand.Float32() * 30
+	// depth := rand.Float32() * 10000
+
+	liveReadings := make([]*pb.LiveModuleReadings, 0)
+
+	for _, m := range status.Modules {
+		entry := lookupModuleEntry(m.Header)
+		if entry == nil {
+			log.Printf("No catalog entry for module %v (%v)", m.Name, m.Header)
+			continue
+		}
+		liveReadings = append(liveReadings, entry.Live(device, m, now))
+	}
+
+	return &pb.HttpReply{
+		Type:            pb.ReplyType_REPLY_READINGS,
+		Status:          status.Status,
+		Streams:         status.Streams,
+		Modules:         status.Modules,
+		Schedules:       status.Schedules,
+		NetworkSettings: status.NetworkSettings,
+		LiveReadings: []*pb.LiveReadings{
+			&pb.LiveReadings{
+				Time:    uint64(now.Unix()),
+				Modules: liveReadings,
+			},
+		},
+	}
+}
+
+func makeBusyReply(delay uint32) *pb.HttpReply {
+	return &pb.HttpReply{
+		Type: pb.ReplyType_REPLY_BUSY,
+		Errors: []*pb.Error{
+			&pb.Error{
+				Delay: delay,
+			},
+		},
+	}
+}
+
+// Status and readings queries both get live readings. The app sends its
+// location with them, which a station without one of its own takes.
+func handleQueryReadings(ctx context.Context, device *FakeDevice, query *pb.HttpQuery, rw ReplyWriter) (err error) {
+	device.lock.Lock()
+	if query != nil && query.Locate != nil {
+		device.Locate(query.Locate.Latitude, query.Locate.Longitude)
+	}
+	reply := makeLiveReadingsReply(device)
+	device.lock.Unlock()
+
+	_, err = rw.WriteReply(reply)
+	return
+}
+
+func handleQueryScanModules(ctx context.Context, device *FakeDevice, query *pb.HttpQuery, rw ReplyWriter) (err error) {
+	device.lock.Lock()
+	device.ScanModules()
+	reply := makeStatusReply(device)
+	device.lock.Unlock()
+	_, err = rw.WriteReply(reply)
+	return
+}
+
+func handleConfigure(ctx context.Context, device *FakeDevice, query *pb.HttpQuery, rw ReplyWriter) (err error) {
+	renamed := false
+
+	device.lock.Lock()
+	if query.Identity != nil && query.Identity.Name != "" && query.Identity.Name != device.State.Identity.Device {
+		device.State.Identity.Device = query.Identity.Name
+		device.logf("config", "name changed to %q", query.Identity.Name)
+		renamed = true
+	}
+	if query.NetworkSettings != nil {
+		fmt.Printf("networks: %v\n", device.State.Networks)
+
+		maxIndex := 0
+
+		for i, newN := range query.NetworkSettings.Networks {
+			maxIndex = i
+
+			fmt.Printf("network[%d]: %s\n", i, newN)
+
+			if i >= len(device.State.Networks) {
+				device.State.Networks = append(device.State.Networks, newN)
+				continue
+			}
+
+			oldN := device.State.Networks[i]
+			if strings.Compare(newN.Ssid, oldN.Ssid) == 0 {
+				if newN.Keeping {
+					continue
+				}
+			}
+
+			device.State.Networks[i] = newN
+		}
+
+		if len(query.NetworkSettings.Networks) == 0 {
+			device.State.Networks = make([]*pb.NetworkInfo, 0)
+		} else {
+			if maxIndex > 0 {
+				device.State.Networks = device.State.Networks[:maxIndex]
+			}
+		}
+
+		fmt.Printf("networks: %v %v\n", device.State.Networks, maxIndex)
+		device.logf("config", "%d networks configured", len(device.State.Networks))
+	}
+	if query.LoraSettings != nil {
+		deviceEui := device.State.Lora.DeviceEui
+		device.State.Lora = query.LoraSettings
+		if device.State.Lora.DeviceEui == nil {
+			device.State.Lora.DeviceEui = deviceEui
+		}
+		device.State.Lora.Modifying = false
+		device.logf("config", "lora settings changed")
+	}
+	if query.Schedules != nil {
+		if query.Schedules.Readings != nil {
+			if query.Schedules.Readings.Intervals != nil {
+				for _, interval := range query.Schedules.Readings.Intervals {
+					log.Printf("interval: %v", interval)
+				}
+			}
+			device.ReadingsSchedule = query.Schedules.Readings
+			device.Reschedule()
+			log.Printf("modified schedule: %v", *device.ReadingsSchedule)
+			device.logf("config", "readings every %ds", device.ReadingsSchedule.Interval)
+		}
+	}
+	device.SaveState()
+	reply := makeStatusReply(device)
+	device.lock.Unlock()
+
+	if renamed {
+		if err := device.Reannounce(); err != nil {
+			log.Printf("%s: error: %v", device.Name, err)
+		}
+	}
+
+	_, err = rw.WriteReply(reply)
+	return
+}
+
+func handleRecordingControl(ctx context.Context, device *FakeDevice, query *pb.HttpQuery, rw ReplyWriter) (err error) {
+	device.lock.Lock()
+	device.SetRecording(query.Recording.Enabled)
+	device.SaveState()
+	reply := makeStatusReply(device)
+	device.lock.Unlock()
+	_, err = rw.WriteReply(reply)
+	return
+}
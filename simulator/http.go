@@ -0,0 +1,728 @@
+package simulator
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/efarrer/iothrottler"
+
+	pb "github.com/fieldkit/app-protocol"
+)
+
+const (
+	CertificateFile = "server_dev.crt"
+	KeyFile         = "server_dev.key"
+	ShutdownTimeout = 5 * time.Second
+)
+
+type HttpServer struct {
+	dispatcher *Dispatcher
+	device     *FakeDevice
+	servers    []*http.Server
+}
+
+func GetDownloadQuery(ctx context.Context, req *http.Request) (*pb.DownloadQuery, error) {
+	/* Hack to support hex encoded encoding. */
+	var reader io.Reader = req.Body
+	contentType := req.Header.Get("Content-Type")
+	hexEncoding := contentType == "text/plain"
+	if hexEncoding {
+		reader = hex.NewDecoder(req.Body)
+	}
+	queries, _, err := ReadLengthPrefixedCollection(ctx, MaximumDataRecordLength, reader, func(bytes []byte) (m proto.Message, err error) {
+		buf := proto.NewBuffer(bytes)
+		downloadQuery := &pb.DownloadQuery{}
+		err = buf.Unmarshal(downloadQuery)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("(http) Query: %v", downloadQuery)
+
+		return downloadQuery, io.EOF
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(queries) > 0 {
+		return queries[0].(*pb.DownloadQuery), nil
+	}
+
+	start := uint64(0)
+	end := uint64(0)
+
+	if firstStr, ok := req.URL.Query()["first"]; ok && len(firstStr) == 1 {
+		start, err = strconv.ParseUint(firstStr[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid first: %v", err)
+		}
+	}
+
+	if lastStr, ok := req.URL.Query()["last"]; ok && len(lastStr) == 1 {
+		end, err = strconv.ParseUint(lastStr[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last: %v", err)
+		}
+	}
+
+	return &pb.DownloadQuery{
+		Ranges: []*pb.Range{
+			&pb.Range{
+				Start: uint32(start),
+				End:   uint32(end),
+			},
+		},
+	}, nil
+}
+
+// DownloadPlan is the records served for a download, in order, along with the
+// block range and number of bytes reported in the headers.
+type DownloadPlan struct {
+	Entries []IndexEntry
+	First   uint64
+	Last    uint64
+	Bytes   uint64
+}
+
+// PlanDownload resolves the ranges in a query against a stream. Like the
+// firmware every range includes Start and excludes End, and an End of 0 means
+// through to the last record. A query without ranges is the whole stream.
+func PlanDownload(stream *StreamState, query *pb.DownloadQuery) *DownloadPlan {
+	ranges := make([]*pb.Range, 0)
+	if query != nil {
+		ranges = query.Ranges
+	}
+	if len(ranges) == 0 {
+		ranges = []*pb.Range{
+			&pb.Range{},
+		}
+	}
+
+	plan := &DownloadPlan{
+		Entries: make([]IndexEntry, 0),
+	}
+
+	first := true
+
+	for _, r := range ranges {
+		start := uint64(r.Start)
+		end := uint64(r.End)
+		if end == 0 {
+			end = math.MaxUint64
+		}
+		if end <= start {
+			continue
+		}
+
+		entries := stream.Entries(start, end)
+		if len(entries) == 0 {
+			continue
+		}
+
+		if first || entries[0].Record < plan.First {
+			plan.First = entries[0].Record
+		}
+		if first || entries[len(entries)-1].Record+1 > plan.Last {
+			plan.Last = entries[len(entries)-1].Record + 1
+		}
+		first = false
+
+		for _, entry := range entries {
+			plan.Bytes += uint64(entry.Size)
+		}
+
+		plan.Entries = append(plan.Entries, entries...)
+	}
+
+	if first {
+		plan.First = uint64(ranges[0].Start)
+		plan.Last = plan.First
+	}
+
+	return plan
+}
+
+func HandleDownload(ctx context.Context, w http.ResponseWriter, req *http.Request, device *FakeDevice, stream *StreamState) error {
+	query, err := GetDownloadQuery(ctx, req)
+	if err != nil {
+		log.Printf("(http) Invalid download query: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+
+	return serveDownload(w, req, device, stream, query)
+}
+
+// serveDownload writes the records a query asks for, once it's been read from
+// the request.
+func serveDownload(w http.ResponseWriter, req *http.Request, device *FakeDevice, stream *StreamState, query *pb.DownloadQuery) error {
+	pool := iothrottler.NewIOThrottlerPool(iothrottler.BytesPerSecond * 50 * 1024)
+
+	defer pool.ReleasePool()
+
+	plan := PlanDownload(stream, query)
+	headOnly := req.Method == "HEAD"
+
+	log.Printf("(http) Downloading (%d -> %d) %d records %d bytes", plan.First, plan.Last, len(plan.Entries), plan.Bytes)
+
+	device.lock.Lock()
+	device.logf("download", "%s records %d to %d, %d bytes", path.Base(req.URL.Path), plan.First, plan.Last, plan.Bytes)
+	device.lock.Unlock()
+
+	w.Header().Set("Fk-Blocks", fmt.Sprintf("%d,%d", plan.First, plan.Last))
+	w.Header().Set("Fk-Generation", fmt.Sprintf("%s", hex.EncodeToString(device.State.Identity.GenerationId)))
+	w.Header().Set("Fk-DeviceId", fmt.Sprintf("%s", hex.EncodeToString(device.State.Identity.DeviceId)))
+
+	file, err := stream.OpenFile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+
+	defer file.Close()
+
+	rw := &HttpReplyWriter{
+		hexEncoding: false,
+		res:         w,
+	}
+
+	rw.Prepare(int(plan.Bytes))
+
+	if headOnly {
+		rw.WriteHeaders(204)
+		return nil
+	}
+
+	rw.WriteHeaders(200)
+
+	if err := rw.Throttle(pool); err != nil {
+		return err
+	}
+
+	for _, entry := range plan.Entries {
+		if _, err := file.Seek(int64(entry.Offset+RecordHeaderSize), io.SeekStart); err != nil {
+			return err
+		}
+
+		if _, err := io.CopyN(rw.writer, file, int64(entry.Size)); err != nil {
+			log.Printf("(http) Download interrupted at record %d: %v", entry.Record, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func HandleFirmware(ctx context.Context, res http.ResponseWriter, req *http.Request, device *FakeDevice) error {
+	log.Printf("(http) Request: %v %v", req.RemoteAddr, req.Method)
+
+	contentType := req.Header.Get("Content-Type")
+
+	/* Hack to support hex encoded encoding. */
+	hexEncoding := contentType == "text/plain"
+
+	rw := &HttpReplyWriter{
+		hexEncoding: hexEncoding,
+		res:         res,
+	}
+
+	if req.Method != http.MethodPost {
+		_, err := rw.WriteStatusBytes(405, []byte("{ \"success\": false }"))
+		return err
+	}
+
+	device.lock.Lock()
+	failure := device.FirmwareFailure
+	device.lock.Unlock()
+
+	upload, err := readFirmwareUpload(req, failure)
+	if err != nil {
+		log.Printf("(http) firmware: %v", err)
+		_, err := rw.WriteStatusBytes(400, []byte("{ \"success\": false }"))
+		return err
+	}
+
+	if failure == FirmwareFailureInterrupted {
+		log.Printf("(http) firmware: interrupting upload after %d bytes", len(upload.Image))
+		ioutil.WriteFile(upload.File(device), upload.Image, 0644)
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := upload.Verify(req, failure); err != nil {
+		log.Printf("(http) firmware: %v", err)
+		device.lock.Lock()
+		device.logf("upgrade", "firmware rejected: %v", err)
+		device.lock.Unlock()
+		_, err := rw.WriteStatusBytes(400, []byte("{ \"success\": false }"))
+		return err
+	}
+
+	if err := ioutil.WriteFile(upload.File(device), upload.Image, 0644); err != nil {
+		return err
+	}
+
+	device.lock.Lock()
+	upload.Apply(device)
+	device.SaveState()
+	device.lock.Unlock()
+
+	if _, err := rw.WriteStatusBytes(200, []byte("{ \"success\": true }")); err != nil {
+		return err
+	}
+
+	device.Reboot()
+
+	return nil
+}
+
+func HandleModule(ctx context.Context, res http.ResponseWriter, req *http.Request, device *FakeDevice, position int) error {
+	log.Printf("(http) Request: %v %v", req.RemoteAddr, req.Method)
+
+	contentType := req.Header.Get("Content-Type")
+
+	var reader io.Reader = req.Body
+
+	/* Hack to support hex encoded encoding. */
+	hexEncoding := contentType == "text/plain"
+	if hexEncoding {
+		reader = hex.NewDecoder(req.Body)
+	}
+
+	_, _, err := ReadLengthPrefixedCollection(ctx, MaximumDataRecordLength, reader, func(bytes []byte) (m proto.Message, err error) {
+		rw := &HttpReplyWriter{
+			hexEncoding: hexEncoding,
+			res:         res,
+		}
+
+		buf := proto.NewBuffer(bytes)
+		wireQuery := &pb.ModuleHttpQuery{}
+		err = buf.Unmarshal(wireQuery)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("(http) module-query[%d]: %v", position, wireQuery)
+
+		device.lock.Lock()
+		reply := configureModule(device, position, wireQuery)
+		device.lock.Unlock()
+
+		data, err := proto.Marshal(reply)
+		if err != nil {
+			panic(err)
+		}
+		buf = proto.NewBuffer(make([]byte, 0))
+		buf.EncodeRawBytes(data)
+
+		_, err = rw.WriteBytes(buf.Bytes())
+
+		log.Printf("(http) module-reply[%d]: %v %v", position, reply.Type, len(reply.Configuration))
+
+		return nil, io.EOF
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return nil
+}
+
+// configureModule handles a module query, the caller holds the device's lock.
+// Resetting clears the module's calibration and configuring stores a new one,
+// either way the reply has the module's configuration.
+func configureModule(device *FakeDevice, position int, query *pb.ModuleHttpQuery) *pb.ModuleHttpReply {
+	module := device.ModuleAt(position)
+	if module == nil {
+		return &pb.ModuleHttpReply{
+			Type: pb.ModuleReplyType_MODULE_REPLY_ERROR,
+			Errors: []*pb.Error{
+				&pb.Error{Message: fmt.Sprintf("no module at %d", position)},
+			},
+		}
+	}
+
+	switch query.Type {
+	case pb.ModuleQueryType_MODULE_QUERY_STATUS:
+		return &pb.ModuleHttpReply{
+			Type:          pb.ModuleReplyType_MODULE_REPLY_SUCCESS,
+			Configuration: module.Configuration,
+		}
+	case pb.ModuleQueryType_MODULE_QUERY_RESET:
+		module.ClearCalibration()
+		device.logf("modules", "module %d calibration cleared", position)
+	default:
+		if err := module.Configure(query.Configuration, uint32(device.Now().Unix())); err != nil {
+			log.Printf("(http) module[%d]: %v", position, err)
+			device.logf("modules", "module %d configuration rejected: %v", position, err)
+			return &pb.ModuleHttpReply{
+				Type: pb.ModuleReplyType_MODULE_REPLY_ERROR,
+				Errors: []*pb.Error{
+					&pb.Error{Message: err.Error()},
+				},
+				Configuration: module.Configuration,
+			}
+		}
+		device.logf("modules", "module %d configured", position)
+	}
+
+	device.State.Streams[1].AppendConfiguration(device)
+	device.SaveState()
+
+	return &pb.ModuleHttpReply{
+		Type:          pb.ModuleReplyType_MODULE_REPLY_SUCCESS,
+		Configuration: module.Configuration,
+	}
+}
+
+// NewHandler serves a station's API, for use with servers of your own such as
+// httptest.Server.
+func NewHandler(device *FakeDevice, dispatcher *Dispatcher) http.Handler {
+	hs := &HttpServer{
+		dispatcher: dispatcher,
+		device:     device,
+	}
+
+	notFoundHandler := http.NotFoundHandler()
+
+	server := http.NewServeMux()
+	server.Handle("/fk/v1", hs)
+	server.HandleFunc("/fk/v1/download/data", func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.Background()
+		HandleDownload(ctx, w, req, device, device.State.Streams[0])
+	})
+	server.HandleFunc("/fk/v1/download/meta", func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.Background()
+		HandleDownload(ctx, w, req, device, device.State.Streams[1])
+	})
+	server.HandleFunc("/fk/v1/modules/0", func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.Background()
+		HandleModule(ctx, w, req, device, 0)
+	})
+	server.HandleFunc("/fk/v1/modules/1", func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.Background()
+		HandleModule(ctx, w, req, device, 1)
+	})
+	server.HandleFunc("/fk/v1/modules/2", func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.Background()
+		HandleModule(ctx, w, req, device, 2)
+	})
+	server.HandleFunc("/fk/v1/modules/3", func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.Background()
+		HandleModule(ctx, w, req, device, 3)
+	})
+	server.HandleFunc("/fk/v1/modules/4", func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.Background()
+		HandleModule(ctx, w, req, device, 4)
+	})
+	server.HandleFunc("/fk/v1/upload/firmware", func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.Background()
+		HandleFirmware(ctx, w, req, device)
+	})
+	server.HandleFunc("/fk/v1/logs.txt", func(w http.ResponseWriter, req *http.Request) {
+		HandleLogs(w, req, device)
+	})
+
+	server.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		log.Printf("Unknown URL: %s", req.URL)
+		notFoundHandler.ServeHTTP(w, req)
+	})
+
+	handler := device.Environment.Faults.Middleware(device, server)
+
+	// Requests in progress take memory, as reported in the status.
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&device.requests, 1)
+		defer atomic.AddInt32(&device.requests, -1)
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func NewHttpServer(device *FakeDevice, dispatcher *Dispatcher) (*HttpServer, error) {
+	hs := &HttpServer{
+		dispatcher: dispatcher,
+		device:     device,
+	}
+
+	handler := NewHandler(device, dispatcher)
+
+	plain := &http.Server{
+		Addr:    net.JoinHostPort(device.Bind, strconv.Itoa(device.Port)),
+		Handler: handler,
+	}
+
+	// Listening before serving means a port that's in use is reported here
+	// rather than lost in a goroutine.
+	listener, err := net.Listen("tcp", plain.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("(http) listening on %s: %v", plain.Addr, err)
+	}
+
+	// Ephemeral ports are kept for the life of the station, so that it comes
+	// back on the same port after a reboot.
+	device.Port = listener.Addr().(*net.TCPAddr).Port
+
+	hs.servers = append(hs.servers, plain)
+
+	go hs.serve(plain, listener, false)
+	log.Printf("(http) Listening on %s", listener.Addr())
+
+	if _, err := tls.LoadX509KeyPair(CertificateFile, KeyFile); err != nil {
+		log.Printf("(https) Disabled: %v", err)
+		return hs, nil
+	}
+
+	secure := &http.Server{
+		Addr:    net.JoinHostPort(device.Bind, strconv.Itoa(device.TlsPort)),
+		Handler: handler,
+	}
+
+	secureListener, err := net.Listen("tcp", secure.Addr)
+	if err != nil {
+		hs.Close()
+		return nil, fmt.Errorf("(https) listening on %s: %v", secure.Addr, err)
+	}
+
+	device.TlsPort = secureListener.Addr().(*net.TCPAddr).Port
+
+	hs.servers = append(hs.servers, secure)
+
+	go hs.serve(secure, secureListener, true)
+	log.Printf("(https) Listening on %s", secureListener.Addr())
+
+	return hs, nil
+}
+
+// Secure is true when the station is also serving TLS.
+func (hs *HttpServer) Secure() bool {
+	return len(hs.servers) > 1
+}
+
+func (hs *HttpServer) serve(server *http.Server, listener net.Listener, secure bool) {
+	var err error
+	if secure {
+		err = server.ServeTLS(listener, CertificateFile, KeyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("(http) Error: %v", err)
+	}
+}
+
+func (hs *HttpServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	ctx := context.Background()
+
+	log.Printf("(http) Request: %v %v", req.RemoteAddr, req.Method)
+
+	contentType := req.Header.Get("Content-Type")
+	contentLength := req.Header.Get("Content-Length")
+
+	log.Printf("(http) Content: %v %v", contentType, contentLength)
+
+	var reader io.Reader = req.Body
+
+	/* Hack to support hex encoded encoding. */
+	hexEncoding := contentType == "text/plain"
+	if hexEncoding {
+		reader = hex.NewDecoder(req.Body)
+	}
+
+	rw := &HttpReplyWriter{
+		hexEncoding: hexEncoding,
+		res:         res,
+	}
+
+	_, i, err := ReadLengthPrefixedCollection(ctx, MaximumDataRecordLength, reader, func(bytes []byte) (m proto.Message, err error) {
+		buf := proto.NewBuffer(bytes)
+		wireQuery := &pb.HttpQuery{}
+		err = buf.Unmarshal(wireQuery)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("(http) Query: %v", wireQuery)
+
+		handler := hs.dispatcher.handlers[wireQuery.Type]
+		if handler == nil {
+			rw.WriteError("Unknown message.")
+			log.Printf("Error handling RPC %v (%v)", "No handler", wireQuery.Type)
+			return
+		}
+
+		err = handler(ctx, hs.device, wireQuery, rw)
+		if err != nil {
+			rw.WriteError("Error handling message.")
+			log.Printf("Error handling RPC %v", err.Error())
+			return
+		}
+
+		return nil, io.EOF
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if i == 0 {
+		handler := hs.dispatcher.handlers[pb.QueryType_QUERY_STATUS]
+		if handler == nil {
+			panic("pb.QueryType_QUERY_STATUS")
+		}
+
+		err = handler(ctx, hs.device, nil, rw)
+		if err != nil {
+			rw.WriteError("Error handling message.")
+			log.Printf("Error handling RPC %v", err.Error())
+			return
+		}
+	}
+}
+
+// Shutdown stops accepting connections and waits for requests in progress.
+func (hs *HttpServer) Shutdown(ctx context.Context) error {
+	for _, server := range hs.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close gives requests in progress ShutdownTimeout to finish and then
+// closes whatever connections remain.
+func (hs *HttpServer) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	if err := hs.Shutdown(ctx); err != nil {
+		log.Printf("(http) Error: %v", err)
+		for _, server := range hs.servers {
+			server.Close()
+		}
+	}
+}
+
+type HttpReplyWriter struct {
+	hexEncoding bool
+	headers     bool
+	size        int
+	res         http.ResponseWriter
+	writer      io.Writer
+}
+
+func (rw *HttpReplyWriter) WriteHeaders(statusCode int) error {
+	if !rw.headers {
+		log.Printf("(http) write headers %v", rw.size)
+		if len(rw.res.Header().Get("Content-Length")) == 0 {
+			rw.res.Header().Set("Content-Length", fmt.Sprintf("%d", rw.size))
+		}
+		if len(rw.res.Header().Get("Content-Type")) == 0 {
+			rw.res.Header().Set("Content-Type", "application/vnd.fk.data+binary")
+		}
+		if len(rw.res.Header().Get("Fk-Bytes")) == 0 {
+			rw.res.Header().Set("Fk-Bytes", fmt.Sprintf("%d", rw.size))
+		}
+		if len(rw.res.Header().Get("Fk-Blocks")) == 0 {
+			rw.res.Header().Set("Fk-Blocks", fmt.Sprintf("%d,%d", 0, 0))
+		}
+		rw.res.WriteHeader(statusCode)
+		rw.headers = true
+	}
+
+	return nil
+}
+
+func (rw *HttpReplyWriter) Close() error {
+	return nil
+}
+
+func (rw *HttpReplyWriter) Prepare(size int) error {
+	rw.size = size
+	return nil
+}
+
+func (rw *HttpReplyWriter) WriteReply(m *pb.HttpReply) (int, error) {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := proto.NewBuffer(make([]byte, 0))
+	buf.EncodeRawBytes(data)
+	bytes := buf.Bytes()
+
+	log.Printf("(http) Writing %d bytes", len(bytes))
+
+	return rw.WriteBytes(bytes)
+}
+
+func (rw *HttpReplyWriter) WriteStatusBytes(statusCode int, bytes []byte) (int, error) {
+	rw.size = len(bytes)
+	err := rw.WriteHeaders(statusCode)
+	if err != nil {
+		return 0, err
+	}
+	return rw.WriteBytes(bytes)
+}
+
+func (rw *HttpReplyWriter) Throttle(pool *iothrottler.IOThrottlerPool) error {
+	w, err := pool.AddWriter(rw)
+	if err != nil {
+		return err
+	}
+	rw.writer = w
+	return nil
+}
+
+func (rw *HttpReplyWriter) Write(bytes []byte) (int, error) {
+	return rw.res.Write(bytes)
+}
+
+func (rw *HttpReplyWriter) WriteBytes(bytes []byte) (int, error) {
+	if !rw.headers {
+		if rw.hexEncoding {
+			rw.size += hex.EncodedLen(len(bytes)) /* This is just N * 2 */
+		} else {
+			rw.size += len(bytes)
+		}
+	}
+
+	rw.WriteHeaders(200)
+
+	if rw.writer == nil {
+		rw.writer = rw.res
+	}
+
+	if rw.hexEncoding {
+		writer := hex.NewEncoder(rw.writer)
+		return writer.Write(bytes)
+	}
+	return rw.writer.Write(bytes)
+}
+
+func (rw *HttpReplyWriter) WriteError(message string) (int, error) {
+	wireReply := &pb.HttpReply{
+		Type: pb.ReplyType_REPLY_ERROR,
+		Errors: []*pb.Error{
+			&pb.Error{
+				Message: message,
+			},
+		},
+	}
+
+	return rw.WriteReply(wireReply)
+}
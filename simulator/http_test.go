@@ -0,0 +1,154 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/fieldkit/app-protocol"
+)
+
+// downloadFile writes records 0 to 9, with bodies of 100 bytes for 0 to 3,
+// 1500 bytes for 4 to 6 and 20 bytes for 7 to 9.
+func downloadFile(t *testing.T, dir string) *StreamState {
+	file := filepath.Join(dir, "data.fkpb")
+	writeRecords(t, file, numbered(0, 4), 100)
+	writeRecords(t, file, numbered(4, 3), 1500)
+	writeRecords(t, file, numbered(7, 3), 20)
+	return openStream(t, file)
+}
+
+func TestDownload(t *testing.T) {
+	cases := []struct {
+		name  string
+		url   string
+		query *pb.DownloadQuery
+		first uint64
+		last  uint64
+		bytes uint64
+	}{
+		{
+			name:  "whole stream",
+			url:   "/fk/v1/download/data",
+			first: 0,
+			last:  10,
+			bytes: 4*100 + 3*1500 + 3*20,
+		},
+		{
+			name:  "first and last",
+			url:   "/fk/v1/download/data?first=2&last=6",
+			first: 2,
+			last:  6,
+			bytes: 2*100 + 2*1500,
+		},
+		{
+			name:  "first only",
+			url:   "/fk/v1/download/data?first=7",
+			first: 7,
+			last:  10,
+			bytes: 3 * 20,
+		},
+		{
+			name:  "first and last equal",
+			url:   "/fk/v1/download/data?first=6&last=6",
+			first: 6,
+			last:  6,
+			bytes: 0,
+		},
+		{
+			name: "end of 0",
+			query: &pb.DownloadQuery{
+				Ranges: []*pb.Range{
+					&pb.Range{Start: 5, End: 0},
+				},
+			},
+			first: 5,
+			last:  10,
+			bytes: 2*1500 + 3*20,
+		},
+		{
+			name: "several ranges",
+			query: &pb.DownloadQuery{
+				Ranges: []*pb.Range{
+					&pb.Range{Start: 0, End: 2},
+					&pb.Range{Start: 5, End: 8},
+				},
+			},
+			first: 0,
+			last:  8,
+			bytes: 2*100 + 2*1500 + 20,
+		},
+		{
+			name: "nothing in range",
+			query: &pb.DownloadQuery{
+				Ranges: []*pb.Range{
+					&pb.Range{Start: 20, End: 30},
+				},
+			},
+			first: 20,
+			last:  20,
+			bytes: 0,
+		},
+		{
+			name: "bodies over 1024 bytes",
+			query: &pb.DownloadQuery{
+				Ranges: []*pb.Range{
+					&pb.Range{Start: 4, End: 7},
+				},
+			},
+			first: 4,
+			last:  7,
+			bytes: 3 * 1500,
+		},
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	env := NewEnvironment(1, NewScaledClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 1))
+	env.Directory = dir
+	device := NewFakeDevice(env, "download", 0, 0, 0)
+	stream := downloadFile(t, dir)
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			url := c.url
+			if url == "" {
+				url = "/fk/v1/download/data"
+			}
+
+			req := httptest.NewRequest("GET", url, nil)
+			w := httptest.NewRecorder()
+
+			var err error
+			if c.query != nil {
+				err = serveDownload(w, req, device, stream, c.query)
+			} else {
+				err = HandleDownload(context.Background(), w, req, device, stream)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := w.Result()
+			expected := map[string]string{
+				"Content-Length": fmt.Sprintf("%d", c.bytes),
+				"Fk-Bytes":       fmt.Sprintf("%d", c.bytes),
+				"Fk-Blocks":      fmt.Sprintf("%d,%d", c.first, c.last),
+			}
+			for name, value := range expected {
+				if actual := res.Header.Get(name); actual != value {
+					t.Errorf("expected %s of %s, got %s", name, value, actual)
+				}
+			}
+
+			if uint64(w.Body.Len()) != c.bytes {
+				t.Errorf("expected %d bytes, got %d", c.bytes, w.Body.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package simulator
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	DeviceLogCapacity = 32 * 1024
+	StatusLogLength   = 4 * 1024
+)
+
+// DeviceLog keeps the station's most recent log lines, dropping the oldest
+// once they'd take more than its capacity like the firmware's log buffer.
+type DeviceLog struct {
+	capacity int
+	lines    []string
+	size     int
+	lock     sync.Mutex
+}
+
+func NewDeviceLog(capacity int) *DeviceLog {
+	return &DeviceLog{
+		capacity: capacity,
+		lines:    make([]string, 0),
+	}
+}
+
+// Printf appends a line in the firmware's format, prefixed with the uptime in
+// milliseconds and the facility it came from.
+func (dl *DeviceLog) Printf(uptime uint32, facility string, format string, args ...interface{}) {
+	line := fmt.Sprintf("%08d %-10s %s\n", uptime, facility, fmt.Sprintf(format, args...))
+
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	dl.lines = append(dl.lines, line)
+	dl.size += len(line)
+
+	dropped := 0
+	for dl.size > dl.capacity && dropped < len(dl.lines)-1 {
+		dl.size -= len(dl.lines[dropped])
+		dropped += 1
+	}
+	dl.lines = dl.lines[dropped:]
+}
+
+// Tail is the most recent lines that fit in size bytes.
+func (dl *DeviceLog) Tail(size int) string {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	first := len(dl.lines)
+	for first > 0 && size >= len(dl.lines[first-1]) {
+		size -= len(dl.lines[first-1])
+		first -= 1
+	}
+
+	return strings.Join(dl.lines[first:], "")
+}
+
+func (dl *DeviceLog) String() string {
+	return dl.Tail(dl.capacity)
+}
+
+func (dl *DeviceLog) Size() int {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	return dl.size
+}
+
+// logf adds to the station's log, the caller holds the lock.
+func (fd *FakeDevice) logf(facility string, format string, args ...interface{}) {
+	fd.Logs.Printf(fd.Uptime(), facility, format, args...)
+}
+
+func HandleLogs(w http.ResponseWriter, req *http.Request, device *FakeDevice) {
+	logs := device.Logs.String()
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(logs)))
+	w.WriteHeader(http.StatusOK)
+
+	if req.Method != http.MethodHead {
+		w.Write([]byte(logs))
+	}
+}
@@ -0,0 +1,357 @@
+package simulator
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	pb "github.com/fieldkit/app-protocol"
+	pbatlas "github.com/fieldkit/atlas-protocol"
+)
+
+const (
+	ManufacturerConservify = 1
+	InternalModulePosition = 0xff
+	InternalModuleFlags    = 1
+	SensorFrequency        = 60
+)
+
+type SensorCatalogEntry struct {
+	Name          string
+	UnitOfMeasure string
+}
+
+type ModuleCatalogEntry struct {
+	Name    string
+	Kind    uint32
+	Flags   uint32
+	Sensors []*SensorCatalogEntry
+	Live    func(device *FakeDevice, m *pb.ModuleCapabilities, now time.Time) *pb.LiveModuleReadings
+}
+
+var waterModuleCatalog = map[pbatlas.SensorType]*ModuleCatalogEntry{
+	pbatlas.SensorType_SENSOR_PH: &ModuleCatalogEntry{
+		Name: "modules.water.ph",
+		Kind: 0x09,
+		Sensors: []*SensorCatalogEntry{
+			&SensorCatalogEntry{Name: "ph", UnitOfMeasure: "pH"},
+		},
+		Live: makeWaterReadings,
+	},
+	pbatlas.SensorType_SENSOR_EC: &ModuleCatalogEntry{
+		Name: "modules.water.ec",
+		Kind: 0x10,
+		Sensors: []*SensorCatalogEntry{
+			&SensorCatalogEntry{Name: "ec", UnitOfMeasure: "µS/cm"},
+		},
+		Live: makeWaterReadings,
+	},
+	pbatlas.SensorType_SENSOR_DO: &ModuleCatalogEntry{
+		Name: "modules.water.do",
+		Kind: 0x11,
+		Sensors: []*SensorCatalogEntry{
+			&SensorCatalogEntry{Name: "do", UnitOfMeasure: "mg/L"},
+		},
+		Live: makeWaterReadings,
+	},
+	pbatlas.SensorType_SENSOR_TEMP: &ModuleCatalogEntry{
+		Name: "modules.water.temp",
+		Kind: 0x12,
+		Sensors: []*SensorCatalogEntry{
+			&SensorCatalogEntry{Name: "temp", UnitOfMeasure: "C"},
+		},
+		Live: makeWaterReadings,
+	},
+	pbatlas.SensorType_SENSOR_ORP: &ModuleCatalogEntry{
+		Name: "modules.water.orp",
+		Kind: 0x13,
+		Sensors: []*SensorCatalogEntry{
+			&SensorCatalogEntry{Name: "orp", UnitOfMeasure: "mV"},
+		},
+		Live: makeWaterReadings,
+	},
+}
+
+var diagnosticsModuleEntry = &ModuleCatalogEntry{
+	Name:  "modules.diagnostics",
+	Kind:  0xa1,
+	Flags: InternalModuleFlags,
+	Sensors: []*SensorCatalogEntry{
+		&SensorCatalogEntry{Name: "battery_charge", UnitOfMeasure: "%"},
+		&SensorCatalogEntry{Name: "battery_voltage", UnitOfMeasure: "mv"},
+		&SensorCatalogEntry{Name: "memory", UnitOfMeasure: "bytes"},
+		&SensorCatalogEntry{Name: "uptime", UnitOfMeasure: "ms"},
+		&SensorCatalogEntry{Name: "temperature", UnitOfMeasure: "C"},
+	},
+	Live: makeDiagnosticsReadings,
+}
+
+var randomModuleEntry = &ModuleCatalogEntry{
+	Name:  "modules.random",
+	Kind:  0xa0,
+	Flags: InternalModuleFlags,
+	Sensors: []*SensorCatalogEntry{
+		&SensorCatalogEntry{Name: "random_0", UnitOfMeasure: ""},
+		&SensorCatalogEntry{Name: "random_1", UnitOfMeasure: ""},
+		&SensorCatalogEntry{Name: "random_2", UnitOfMeasure: ""},
+		&SensorCatalogEntry{Name: "random_3", UnitOfMeasure: ""},
+	},
+	Live: makeRandomReadings,
+}
+
+func lookupModuleEntry(header *pb.ModuleHeader) *ModuleCatalogEntry {
+	if header == nil || header.Manufacturer != ManufacturerConservify {
+		return nil
+	}
+	for _, entry := range waterModuleCatalog {
+		if entry.Kind == header.Kind {
+			return entry
+		}
+	}
+	for _, entry := range []*ModuleCatalogEntry{diagnosticsModuleEntry, randomModuleEntry} {
+		if entry.Kind == header.Kind {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (e *ModuleCatalogEntry) capabilities(device *FakeDevice, position int, generation uint32, configuration []byte) *pb.ModuleCapabilities {
+	sensors := make([]*pb.SensorCapabilities, 0)
+	for i, s := range e.Sensors {
+		sensors = append(sensors, &pb.SensorCapabilities{
+			Number:        uint32(i),
+			Name:          s.Name,
+			UnitOfMeasure: s.UnitOfMeasure,
+			Frequency:     SensorFrequency,
+		})
+	}
+	return generateModuleId(position, generation, device, &pb.ModuleCapabilities{
+		Position:      uint32(position),
+		Flags:         e.Flags,
+		Name:          e.Name,
+		Configuration: configuration,
+		Header: &pb.ModuleHeader{
+			Manufacturer: ManufacturerConservify,
+			Kind:         e.Kind,
+			Version:      0,
+		},
+		Sensors: sensors,
+	})
+}
+
+func sortedModules(device *FakeDevice) []*FakeModule {
+	modules := make([]*FakeModule, len(device.Modules))
+	copy(modules, device.Modules)
+	sort.Slice(modules, func(i, j int) bool {
+		return modules[i].Position < modules[j].Position
+	})
+	return modules
+}
+
+// Modules are hot-plugged onto the bus, which the firmware only looks at when
+// it scans for modules, at boot or when the app asks. Until then the station
+// keeps reporting the modules it found last. The caller holds the lock for
+// all of these.
+func (fd *FakeDevice) Bus() []*FakeModule {
+	if fd.attached != nil {
+		return fd.attached
+	}
+	return fd.Modules
+}
+
+func (fd *FakeDevice) busAt(position int) *FakeModule {
+	for _, m := range fd.Bus() {
+		if m.Position == position {
+			return m
+		}
+	}
+	return nil
+}
+
+func (fd *FakeDevice) setBus(modules []*FakeModule) {
+	fd.attached = modules
+	fd.SaveState()
+}
+
+// plugged readies a module for the bus, giving it a generation so that its id
+// differs from any module that was there before.
+func (fd *FakeDevice) plugged(module *FakeModule) *FakeModule {
+	fd.ModuleGeneration += 1
+	module.setGeneration(fd, fd.ModuleGeneration)
+	return module
+}
+
+// setGeneration makes the module a different piece of hardware, with its own
+// probe error.
+func (m *FakeModule) setGeneration(device *FakeDevice, generation uint32) {
+	m.Generation = generation
+	if generation > 0 {
+		m.Probe = NewProbe(m.SensorType, device.Environment.SeedFor(fmt.Sprintf("%s-%d-%d-probe", device.Name, m.Position, generation)))
+	}
+}
+
+func (fd *FakeDevice) AttachModule(module *FakeModule) error {
+	if fd.busAt(module.Position) != nil {
+		return fmt.Errorf("position %d is already occupied", module.Position)
+	}
+
+	modules := append([]*FakeModule{}, fd.Bus()...)
+	fd.setBus(append(modules, fd.plugged(module)))
+
+	log.Printf("%s: attached %v at %d", fd.Name, SensorTypeName(module.SensorType), module.Position)
+
+	return nil
+}
+
+func (fd *FakeDevice) DetachModule(position int) error {
+	modules := make([]*FakeModule, 0)
+	for _, m := range fd.Bus() {
+		if m.Position != position {
+			modules = append(modules, m)
+		}
+	}
+
+	if len(modules) == len(fd.Bus()) {
+		return fmt.Errorf("no module at position %d", position)
+	}
+
+	fd.setBus(modules)
+
+	log.Printf("%s: detached %d", fd.Name, position)
+
+	return nil
+}
+
+// SwapModule replaces the module at a position, like unplugging one and
+// plugging in another before the station notices.
+func (fd *FakeDevice) SwapModule(module *FakeModule) error {
+	if fd.busAt(module.Position) == nil {
+		return fmt.Errorf("no module at position %d", module.Position)
+	}
+
+	modules := make([]*FakeModule, 0)
+	for _, m := range fd.Bus() {
+		if m.Position == module.Position {
+			modules = append(modules, fd.plugged(module))
+		} else {
+			modules = append(modules, m)
+		}
+	}
+
+	fd.setBus(modules)
+
+	log.Printf("%s: swapped %d for %v", fd.Name, module.Position, SensorTypeName(module.SensorType))
+
+	return nil
+}
+
+// ScanModules finds the modules on the bus, writing a new meta record when
+// they've changed. Returns true if they had.
+func (fd *FakeDevice) ScanModules() bool {
+	if fd.attached == nil {
+		return false
+	}
+
+	fd.Modules = fd.attached
+	fd.attached = nil
+
+	fd.State.Streams[1].AppendConfiguration(fd)
+	fd.SaveState()
+	fd.logf("modules", "found %d modules", len(fd.Modules))
+
+	log.Printf("%s: scanned %d modules", fd.Name, len(fd.Modules))
+
+	return true
+}
+
+func makeModules(device *FakeDevice) []*pb.ModuleCapabilities {
+	modules := make([]*pb.ModuleCapabilities, 0)
+	if len(device.Modules) == 0 {
+		return modules
+	}
+	for _, m := range sortedModules(device) {
+		entry := waterModuleCatalog[m.SensorType]
+		if entry == nil {
+			continue
+		}
+		modules = append(modules, entry.capabilities(device, m.Position, m.Generation, m.Configuration))
+	}
+	modules = append(modules, diagnosticsModuleEntry.capabilities(device, InternalModulePosition, 0, nil))
+	modules = append(modules, randomModuleEntry.capabilities(device, InternalModulePosition, 0, nil))
+	return modules
+}
+
+// makeDiagnosticsReadings are the station's own sensors, at now for readings
+// that are stored. Memory is what's available at the time it's read.
+func makeDiagnosticsReadings(device *FakeDevice, m *pb.ModuleCapabilities, now time.Time) *pb.LiveModuleReadings {
+	return &pb.LiveModuleReadings{
+		Module: m,
+		Readings: []*pb.LiveSensorReading{
+			&pb.LiveSensorReading{
+				Sensor: m.Sensors[0],
+				Value:  float32(device.Power.Battery.Percentage),
+			},
+			&pb.LiveSensorReading{
+				Sensor: m.Sensors[1],
+				Value:  float32(device.Power.Battery.Voltage),
+			},
+			&pb.LiveSensorReading{
+				Sensor: m.Sensors[2],
+				Value:  float32(sramAvailable(device, now)),
+			},
+			&pb.LiveSensorReading{
+				Sensor: m.Sensors[3],
+				Value:  float32(device.UptimeAt(now)),
+			},
+			&pb.LiveSensorReading{
+				Sensor: m.Sensors[4],
+				Value:  device.Enclosure.Sample(now),
+			},
+		},
+	}
+}
+
+func makeRandomReadings(device *FakeDevice, m *pb.ModuleCapabilities, now time.Time) *pb.LiveModuleReadings {
+	random := device.randomAt(fmt.Sprintf("%s-%d", m.Name, m.Position), now)
+	readings := make([]*pb.LiveSensorReading, 0)
+	for _, sensor := range m.Sensors {
+		readings = append(readings, &pb.LiveSensorReading{
+			Sensor: sensor,
+			Value:  random.Float32(),
+		})
+	}
+	return &pb.LiveModuleReadings{
+		Module:   m,
+		Readings: readings,
+	}
+}
+
+// makeWaterReadings reads the module's signal through its probe, so that
+// uncalibrated values are off until the module is calibrated. Factory is the
+// probe's reading before its error, as if it were calibrated at the factory.
+func makeWaterReadings(device *FakeDevice, m *pb.ModuleCapabilities, now time.Time) *pb.LiveModuleReadings {
+	var factory, uncalibrated, value float32
+	fm := device.ModuleAt(int(m.Position))
+	if fm != nil && fm.Signal != nil {
+		factory = fm.Signal.Sample(now)
+		uncalibrated = fm.Probe.Read(factory)
+		value = Calibrate(fm.calibration, uncalibrated)
+	} else {
+		value = device.randomAt(fmt.Sprintf("%s-%d", m.Name, m.Position), now).Float32()
+		factory = value
+		uncalibrated = value
+	}
+	return &pb.LiveModuleReadings{
+		Module: m,
+		Readings: []*pb.LiveSensorReading{
+			&pb.LiveSensorReading{
+				Sensor:       m.Sensors[0],
+				Uncalibrated: uncalibrated,
+				Value:        value,
+				Factory:      factory,
+			},
+		},
+	}
+}
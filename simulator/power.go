@@ -0,0 +1,255 @@
+package simulator
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	LowBattery                = 20
+	CriticalBattery           = 5
+	LowBatteryReadingInterval = 15 * time.Minute
+
+	// On the simulated clock, so that a stepped clock can still jump ahead
+	// a minute at a time.
+	PowerCheckInterval = time.Minute
+)
+
+// PowerParameters describes a station's battery and solar panel. Currents
+// are in mA, charges in mAh and voltages in mV. The panel produces a half sine
+// between sunrise and sunset, in hours of the simulated clock's day.
+type PowerParameters struct {
+	Capacity      float64 `yaml:"capacity" json:"capacity"`
+	IdleCurrent   float64 `yaml:"idle_current" json:"idle_current"`
+	ReadingCharge float64 `yaml:"reading_charge" json:"reading_charge"`
+	SolarCurrent  float64 `yaml:"solar_current" json:"solar_current"`
+	SolarVoltage  float64 `yaml:"solar_voltage" json:"solar_voltage"`
+	Sunrise       float64 `yaml:"sunrise" json:"sunrise"`
+	Sunset        float64 `yaml:"sunset" json:"sunset"`
+}
+
+var DefaultPowerParameters = PowerParameters{
+	Capacity:      2200,
+	IdleCurrent:   5,
+	ReadingCharge: 0.4,
+	SolarCurrent:  200,
+	SolarVoltage:  6000,
+	Sunrise:       6,
+	Sunset:        18,
+}
+
+// Parameters that are left out keep their defaults.
+func (p *PowerParameters) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain PowerParameters
+	*p = DefaultPowerParameters
+	return unmarshal((*plain)(p))
+}
+
+func (p *PowerParameters) UnmarshalJSON(data []byte) error {
+	type plain PowerParameters
+	*p = DefaultPowerParameters
+	return unmarshalJsonStrict(data, (*plain)(p))
+}
+
+func (p *PowerParameters) Validate() error {
+	if p.Capacity <= 0 {
+		return fmt.Errorf("capacity: %v should be positive", p.Capacity)
+	}
+	for name, value := range map[string]float64{
+		"idle_current":   p.IdleCurrent,
+		"reading_charge": p.ReadingCharge,
+		"solar_current":  p.SolarCurrent,
+		"solar_voltage":  p.SolarVoltage,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s: %v is negative", name, value)
+		}
+	}
+	if p.Sunrise < 0 || p.Sunset > 24 || p.Sunrise >= p.Sunset {
+		return fmt.Errorf("sunrise and sunset: %v-%v should be hours of the day, in order", p.Sunrise, p.Sunset)
+	}
+	return nil
+}
+
+// Battery voltages of a LiPo cell by charge, interpolated between.
+var batteryCurve = []struct {
+	percentage float64
+	voltage    float64
+}{
+	{0, 3300},
+	{10, 3600},
+	{20, 3700},
+	{50, 3800},
+	{80, 3950},
+	{100, 4150},
+}
+
+func batteryVoltage(percentage float64) float64 {
+	for i := 1; i < len(batteryCurve); i += 1 {
+		low, high := batteryCurve[i-1], batteryCurve[i]
+		if percentage <= high.percentage {
+			f := (percentage - low.percentage) / (high.percentage - low.percentage)
+			return low.voltage + math.Max(0, f)*(high.voltage-low.voltage)
+		}
+	}
+	return batteryCurve[len(batteryCurve)-1].voltage
+}
+
+func batteryPercentage(voltage float64) float64 {
+	for i := 1; i < len(batteryCurve); i += 1 {
+		low, high := batteryCurve[i-1], batteryCurve[i]
+		if voltage <= high.voltage {
+			f := (voltage - low.voltage) / (high.voltage - low.voltage)
+			return low.percentage + math.Max(0, f)*(high.percentage-low.percentage)
+		}
+	}
+	return 100
+}
+
+// PowerModel charges the battery from the sun and drains it with the
+// station's idle current and each reading it takes.
+type PowerModel struct {
+	params PowerParameters
+	charge float64
+	solar  *float64
+	last   time.Time
+}
+
+func NewPowerModel(params PowerParameters, percentage float64) *PowerModel {
+	pm := &PowerModel{
+		params: params,
+	}
+	pm.SetPercentage(percentage)
+	return pm
+}
+
+func (pm *PowerModel) sun(now time.Time) float64 {
+	if pm.solar != nil {
+		if pm.params.SolarVoltage == 0 {
+			return 0
+		}
+		return math.Min(1, *pm.solar/pm.params.SolarVoltage)
+	}
+	hour := float64(now.Hour()) + float64(now.Minute())/60.0
+	if hour < pm.params.Sunrise || hour > pm.params.Sunset {
+		return 0
+	}
+	return math.Sin(math.Pi * (hour - pm.params.Sunrise) / (pm.params.Sunset - pm.params.Sunrise))
+}
+
+// Advance integrates the charge up to now, a minute at a time unless that's
+// more than MaximumSimulationSteps.
+func (pm *PowerModel) Advance(now time.Time) {
+	if pm.last.IsZero() {
+		pm.last = now
+		return
+	}
+
+	step := time.Minute
+	if elapsed := now.Sub(pm.last); elapsed > MaximumSimulationSteps*time.Minute {
+		step = elapsed / MaximumSimulationSteps
+	}
+
+	for pm.last.Before(now) {
+		if remaining := now.Sub(pm.last); remaining < step {
+			step = remaining
+		}
+		current := pm.params.SolarCurrent*pm.sun(pm.last) - pm.params.IdleCurrent
+		pm.add(current * step.Hours())
+		pm.last = pm.last.Add(step)
+	}
+}
+
+func (pm *PowerModel) add(charge float64) {
+	pm.charge = math.Max(0, math.Min(pm.params.Capacity, pm.charge+charge))
+}
+
+// Reading takes the charge used by one reading.
+func (pm *PowerModel) Reading() {
+	pm.add(-pm.params.ReadingCharge)
+}
+
+func (pm *PowerModel) Percentage() float64 {
+	return pm.charge / pm.params.Capacity * 100
+}
+
+func (pm *PowerModel) SetPercentage(percentage float64) {
+	pm.charge = math.Max(0, math.Min(100, percentage)) / 100 * pm.params.Capacity
+}
+
+func (pm *PowerModel) SetVoltage(voltage float64) {
+	pm.SetPercentage(batteryPercentage(voltage))
+}
+
+// PinSolarVoltage fixes the panel's voltage, as though the weather held.
+func (pm *PowerModel) PinSolarVoltage(voltage float64) {
+	pm.solar = &voltage
+}
+
+func (pm *PowerModel) SolarVoltage(now time.Time) float64 {
+	return pm.params.SolarVoltage * pm.sun(now)
+}
+
+// updatePower brings the reported power status up to date, the caller holds
+// the lock.
+func (fd *FakeDevice) updatePower() {
+	now := fd.Now()
+	fd.PowerModel.Advance(now)
+	percentage := fd.PowerModel.Percentage()
+	fd.Power.Battery.Percentage = uint32(math.Round(percentage))
+	fd.Power.Battery.Voltage = uint32(math.Round(batteryVoltage(percentage)))
+	fd.Power.Solar.Voltage = uint32(math.Round(fd.PowerModel.SolarVoltage(now)))
+}
+
+// LowPower is true when the station stretches out its readings, the caller
+// holds the lock.
+func (fd *FakeDevice) LowPower() bool {
+	return fd.PowerModel.Percentage() < LowBattery
+}
+
+// SimulatePower takes the station offline when its battery is nearly flat,
+// and brings it back once it's charged to LowBattery again. Checks are timed
+// by the simulated clock, like readings, so brown outs are reproducible.
+func (fd *FakeDevice) SimulatePower() {
+	for {
+		timer := fd.Environment.Clock.NewTimer(PowerCheckInterval)
+
+		select {
+		case <-timer.C:
+		case <-fd.closed:
+			timer.Stop()
+			return
+		}
+
+		fd.lock.Lock()
+		fd.updatePower()
+		percentage := fd.PowerModel.Percentage()
+		stop := percentage < CriticalBattery && fd.online
+		start := percentage >= LowBattery && fd.browned
+		if stop {
+			fd.browned = true
+			fd.logf("power", "battery critical (%.1f%%), shutting down", percentage)
+		}
+		if start {
+			fd.browned = false
+			fd.BootTime = fd.Now()
+			fd.GpsModel.ColdStart(fd.BootTime)
+			fd.logf("startup", "%s starting, firmware %s", fd.Name, fd.Firmware.Version)
+		}
+		dispatcher := fd.dispatcher
+		fd.lock.Unlock()
+
+		if stop {
+			log.Printf("%s battery critical (%.1f%%)", fd.Name, percentage)
+			fd.Stop()
+		}
+		if start {
+			log.Printf("%s battery recovered (%.1f%%)", fd.Name, percentage)
+			if err := fd.Start(dispatcher); err != nil {
+				log.Printf("%s: error starting: %v", fd.Name, err)
+			}
+		}
+	}
+}
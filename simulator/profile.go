@@ -0,0 +1,482 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	pb "github.com/fieldkit/app-protocol"
+	pbatlas "github.com/fieldkit/atlas-protocol"
+)
+
+const (
+	MaximumModulePosition = 4
+)
+
+// BasePort of 0 gives every station without a port an ephemeral one.
+type Profile struct {
+	BasePort *int              `yaml:"base_port" json:"base_port"`
+	Bind     string            `yaml:"bind" json:"bind"`
+	Stations []*StationProfile `yaml:"stations" json:"stations"`
+}
+
+type StationProfile struct {
+	Name      string            `yaml:"name" json:"name"`
+	Port      int               `yaml:"port" json:"port"`
+	TlsPort   int               `yaml:"tls_port" json:"tls_port"`
+	Modules   []*ModuleProfile  `yaml:"modules" json:"modules"`
+	Firmware  *FirmwareProfile  `yaml:"firmware" json:"firmware"`
+	Networks  []*NetworkProfile `yaml:"networks" json:"networks"`
+	Lora      *LoraProfile      `yaml:"lora" json:"lora"`
+	Schedules *SchedulesProfile `yaml:"schedules" json:"schedules"`
+	Location  *LocationProfile  `yaml:"location" json:"location"`
+	Battery   *BatteryProfile   `yaml:"battery" json:"battery"`
+}
+
+type ModuleProfile struct {
+	Position   int               `yaml:"position" json:"position"`
+	Sensor     string            `yaml:"sensor" json:"sensor"`
+	Simulation *SignalParameters `yaml:"simulation" json:"simulation"`
+}
+
+// A module's simulation starts from the defaults for its sensor, so the
+// parameters that are left out keep them. An unknown sensor is left for
+// Validate to report.
+func (mp *ModuleProfile) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ModuleProfile
+	if err := unmarshal((*plain)(mp)); err != nil {
+		return err
+	}
+	if mp.Simulation == nil {
+		return nil
+	}
+	sensorType, err := ParseSensorType(mp.Sensor)
+	if err != nil {
+		return nil
+	}
+	params := defaultSignalParameters[sensorType]
+	mp.Simulation = &params
+	return unmarshal((*plain)(mp))
+}
+
+func (mp *ModuleProfile) UnmarshalJSON(data []byte) error {
+	type plain ModuleProfile
+	if err := unmarshalJsonStrict(data, (*plain)(mp)); err != nil {
+		return err
+	}
+	if mp.Simulation == nil {
+		return nil
+	}
+	sensorType, err := ParseSensorType(mp.Sensor)
+	if err != nil {
+		return nil
+	}
+	params := defaultSignalParameters[sensorType]
+	mp.Simulation = &params
+	return unmarshalJsonStrict(data, (*plain)(mp))
+}
+
+type FirmwareProfile struct {
+	Version   string `yaml:"version" json:"version"`
+	Number    string `yaml:"number" json:"number"`
+	Hash      string `yaml:"hash" json:"hash"`
+	Timestamp uint64 `yaml:"timestamp" json:"timestamp"`
+}
+
+type NetworkProfile struct {
+	Ssid     string `yaml:"ssid" json:"ssid"`
+	Password string `yaml:"password" json:"password"`
+}
+
+type LoraProfile struct {
+	FrequencyBand uint32 `yaml:"frequency_band" json:"frequency_band"`
+	AppKey        string `yaml:"app_key" json:"app_key"`
+	JoinEui       string `yaml:"join_eui" json:"join_eui"`
+}
+
+type IntervalProfile struct {
+	Start    uint64 `yaml:"start" json:"start"`
+	End      uint64 `yaml:"end" json:"end"`
+	Interval uint32 `yaml:"interval" json:"interval"`
+}
+
+type ScheduleProfile struct {
+	Interval  uint32             `yaml:"interval" json:"interval"`
+	Intervals []*IntervalProfile `yaml:"intervals" json:"intervals"`
+}
+
+type SchedulesProfile struct {
+	Readings *ScheduleProfile `yaml:"readings" json:"readings"`
+	Lora     *ScheduleProfile `yaml:"lora" json:"lora"`
+	Network  *ScheduleProfile `yaml:"network" json:"network"`
+	Gps      *ScheduleProfile `yaml:"gps" json:"gps"`
+}
+
+type LocationProfile struct {
+	Latitude   float32        `yaml:"latitude" json:"latitude"`
+	Longitude  float32        `yaml:"longitude" json:"longitude"`
+	Simulation *GpsParameters `yaml:"simulation" json:"simulation"`
+}
+
+type BatteryProfile struct {
+	Voltage      uint32           `yaml:"voltage" json:"voltage"`
+	Percentage   uint32           `yaml:"percentage" json:"percentage"`
+	SolarVoltage uint32           `yaml:"solar_voltage" json:"solar_voltage"`
+	Simulation   *PowerParameters `yaml:"simulation" json:"simulation"`
+}
+
+var sensorTypesByName = map[string]pbatlas.SensorType{
+	"ph":   pbatlas.SensorType_SENSOR_PH,
+	"ec":   pbatlas.SensorType_SENSOR_EC,
+	"temp": pbatlas.SensorType_SENSOR_TEMP,
+	"do":   pbatlas.SensorType_SENSOR_DO,
+	"orp":  pbatlas.SensorType_SENSOR_ORP,
+}
+
+func ParseSensorType(name string) (pbatlas.SensorType, error) {
+	if st, ok := sensorTypesByName[strings.ToLower(name)]; ok {
+		return st, nil
+	}
+	if value, ok := pbatlas.SensorType_value[strings.ToUpper(name)]; ok && value != 0 {
+		return pbatlas.SensorType(value), nil
+	}
+	return 0, fmt.Errorf("unknown sensor type %q", name)
+}
+
+func SensorTypeName(sensorType pbatlas.SensorType) string {
+	for name, st := range sensorTypesByName {
+		if st == sensorType {
+			return name
+		}
+	}
+	return strings.ToLower(sensorType.String())
+}
+
+// unmarshalJsonStrict refuses fields it doesn't know, like
+// yaml.UnmarshalStrict, so misspelled settings aren't silently ignored.
+func unmarshalJsonStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func LoadProfile(path string) (*Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading profile: %v", err)
+	}
+
+	profile := &Profile{}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = unmarshalJsonStrict(data, profile)
+	default:
+		err = yaml.UnmarshalStrict(data, profile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing profile %s: %v", path, err)
+	}
+
+	if err := profile.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %v", path, err)
+	}
+
+	log.Printf("Loaded profile %s (%d stations)", path, len(profile.Stations))
+
+	return profile, nil
+}
+
+func (p *Profile) Validate() error {
+	if len(p.Stations) == 0 {
+		return fmt.Errorf("no stations")
+	}
+
+	if p.BasePort != nil && (*p.BasePort < 0 || *p.BasePort > 65535) {
+		return fmt.Errorf("base_port: %d is out of range", *p.BasePort)
+	}
+
+	names := make(map[string]bool)
+
+	for i, station := range p.Stations {
+		if station == nil || station.Name == "" {
+			return fmt.Errorf("stations[%d]: name is required", i)
+		}
+		if names[station.Name] {
+			return fmt.Errorf("station %q: duplicate name", station.Name)
+		}
+		names[station.Name] = true
+
+		if station.Port < 0 || station.Port > 65535 {
+			return fmt.Errorf("station %q: port: %d is out of range", station.Name, station.Port)
+		}
+		if station.TlsPort < 0 || station.TlsPort > 65535 {
+			return fmt.Errorf("station %q: tls_port: %d is out of range", station.Name, station.TlsPort)
+		}
+		if station.TlsPort == 0 && station.Port > 65535-TlsPortOffset {
+			return fmt.Errorf("station %q: port: %d leaves no room for tls_port", station.Name, station.Port)
+		}
+
+		if err := station.validate(); err != nil {
+			return fmt.Errorf("station %q: %v", station.Name, err)
+		}
+	}
+
+	basePort := BasePort
+	if p.BasePort != nil {
+		basePort = *p.BasePort
+	}
+
+	return p.CheckPorts(basePort)
+}
+
+// CheckPorts looks for stations that would listen on the same port, with
+// those that have no port of their own numbered up from basePort.
+func (p *Profile) CheckPorts(basePort int) error {
+	ports := make(map[int]string)
+
+	for i, station := range p.Stations {
+		port := station.Port
+		if port == 0 {
+			port = PortFor(basePort, i)
+		}
+		if port == 0 {
+			continue
+		}
+
+		tlsPort := station.TlsPort
+		if tlsPort == 0 {
+			tlsPort = port + TlsPortOffset
+		}
+
+		for _, used := range []int{port, tlsPort} {
+			if other, ok := ports[used]; ok {
+				return fmt.Errorf("station %q: port: %d is already used by %q", station.Name, used, other)
+			}
+			ports[used] = station.Name
+		}
+	}
+
+	return nil
+}
+
+func (sp *StationProfile) validate() error {
+	positions := make(map[int]bool)
+	for i, m := range sp.Modules {
+		if m == nil {
+			return fmt.Errorf("modules[%d]: empty module", i)
+		}
+		if m.Position < 0 || m.Position > MaximumModulePosition {
+			return fmt.Errorf("modules[%d].position: %d is out of range (0-%d)", i, m.Position, MaximumModulePosition)
+		}
+		if positions[m.Position] {
+			return fmt.Errorf("modules[%d].position: %d is already occupied", i, m.Position)
+		}
+		positions[m.Position] = true
+		if _, err := ParseSensorType(m.Sensor); err != nil {
+			return fmt.Errorf("modules[%d].sensor: %v", i, err)
+		}
+		if m.Simulation != nil {
+			if err := m.Simulation.Validate(); err != nil {
+				return fmt.Errorf("modules[%d].simulation.%v", i, err)
+			}
+		}
+	}
+
+	for i, n := range sp.Networks {
+		if n == nil || n.Ssid == "" {
+			return fmt.Errorf("networks[%d].ssid: is required", i)
+		}
+	}
+
+	if sp.Lora != nil {
+		if _, err := hex.DecodeString(sp.Lora.AppKey); err != nil {
+			return fmt.Errorf("lora.app_key: %v", err)
+		}
+		if _, err := hex.DecodeString(sp.Lora.JoinEui); err != nil {
+			return fmt.Errorf("lora.join_eui: %v", err)
+		}
+	}
+
+	if sp.Schedules != nil {
+		schedules := map[string]*ScheduleProfile{
+			"readings": sp.Schedules.Readings,
+			"lora":     sp.Schedules.Lora,
+			"network":  sp.Schedules.Network,
+			"gps":      sp.Schedules.Gps,
+		}
+		for name, schedule := range schedules {
+			if schedule == nil {
+				continue
+			}
+			for i, interval := range schedule.Intervals {
+				if interval == nil || interval.End > 86400 || interval.Start > interval.End {
+					return fmt.Errorf("schedules.%s.intervals[%d]: invalid window", name, i)
+				}
+			}
+		}
+	}
+
+	if sp.Location != nil {
+		if sp.Location.Latitude < -90 || sp.Location.Latitude > 90 {
+			return fmt.Errorf("location.latitude: %v is out of range", sp.Location.Latitude)
+		}
+		if sp.Location.Longitude < -180 || sp.Location.Longitude > 180 {
+			return fmt.Errorf("location.longitude: %v is out of range", sp.Location.Longitude)
+		}
+		if sp.Location.Simulation != nil {
+			if err := sp.Location.Simulation.Validate(); err != nil {
+				return fmt.Errorf("location.simulation.%v", err)
+			}
+		}
+	}
+
+	if sp.Battery != nil && sp.Battery.Percentage > 100 {
+		return fmt.Errorf("battery.percentage: %d is out of range", sp.Battery.Percentage)
+	}
+	if sp.Battery != nil && sp.Battery.Simulation != nil {
+		if err := sp.Battery.Simulation.Validate(); err != nil {
+			return fmt.Errorf("battery.simulation.%v", err)
+		}
+	}
+
+	return nil
+}
+
+func (sp *ScheduleProfile) toSchedule() *pb.Schedule {
+	schedule := &pb.Schedule{
+		Interval:  sp.Interval,
+		Intervals: make([]*pb.Interval, 0),
+	}
+	for _, interval := range sp.Intervals {
+		schedule.Intervals = append(schedule.Intervals, &pb.Interval{
+			Start:    interval.Start,
+			End:      interval.End,
+			Interval: interval.Interval,
+		})
+	}
+	return schedule
+}
+
+func (mp *ModuleProfile) toModule(device *FakeDevice) *FakeModule {
+	sensorType, _ := ParseSensorType(mp.Sensor)
+	module := NewFakeModule(device.Environment, device.Name, mp.Position, sensorType)
+	if mp.Simulation != nil {
+		params := *mp.Simulation
+		if params.Seed == 0 {
+			params.Seed = device.Environment.SeedFor(fmt.Sprintf("%s-%d", device.Name, mp.Position))
+		}
+		module.Signal = NewSimulatedSignal(params)
+	}
+	return module
+}
+
+func (sp *StationProfile) Apply(device *FakeDevice) {
+	if sp.Modules != nil {
+		device.Modules = make([]*FakeModule, 0)
+		for _, m := range sp.Modules {
+			device.Modules = append(device.Modules, m.toModule(device))
+		}
+	}
+
+	if sp.Firmware != nil {
+		if sp.Firmware.Version != "" {
+			device.Firmware.Version = sp.Firmware.Version
+		}
+		if sp.Firmware.Number != "" {
+			device.Firmware.Number = sp.Firmware.Number
+		}
+		if sp.Firmware.Hash != "" {
+			device.Firmware.Hash = sp.Firmware.Hash
+		}
+		if sp.Firmware.Timestamp > 0 {
+			device.Firmware.Timestamp = sp.Firmware.Timestamp
+		}
+	}
+
+	if sp.Networks != nil {
+		device.State.Networks = make([]*pb.NetworkInfo, 0)
+		for _, n := range sp.Networks {
+			device.State.Networks = append(device.State.Networks, &pb.NetworkInfo{
+				Ssid:     n.Ssid,
+				Password: n.Password,
+			})
+		}
+	}
+
+	if sp.Lora != nil {
+		appKey, _ := hex.DecodeString(sp.Lora.AppKey)
+		joinEui, _ := hex.DecodeString(sp.Lora.JoinEui)
+		device.State.Lora.FrequencyBand = sp.Lora.FrequencyBand
+		device.State.Lora.AppKey = appKey
+		device.State.Lora.JoinEui = joinEui
+	}
+
+	if sp.Schedules != nil {
+		if sp.Schedules.Readings != nil {
+			device.ReadingsSchedule = sp.Schedules.Readings.toSchedule()
+		}
+		if sp.Schedules.Lora != nil {
+			device.LoraSchedule = sp.Schedules.Lora.toSchedule()
+		}
+		if sp.Schedules.Network != nil {
+			device.NetworkSchedule = sp.Schedules.Network.toSchedule()
+		}
+		if sp.Schedules.Gps != nil {
+			device.GpsSchedule = sp.Schedules.Gps.toSchedule()
+		}
+	}
+
+	if sp.Location != nil {
+		if sp.Location.Latitude != 0 || sp.Location.Longitude != 0 {
+			device.Latitude = sp.Location.Latitude
+			device.Longitude = sp.Location.Longitude
+		}
+		if sp.Location.Simulation != nil {
+			device.GpsModel = NewGpsModel(*sp.Location.Simulation, device.Environment.SeedFor(fmt.Sprintf("%s-gps", device.Name)))
+		}
+		device.updateGps()
+	}
+
+	if sp.Battery != nil {
+		if sp.Battery.Simulation != nil {
+			device.PowerModel = NewPowerModel(*sp.Battery.Simulation, device.PowerModel.Percentage())
+		}
+		if sp.Battery.Voltage > 0 {
+			device.PowerModel.SetVoltage(float64(sp.Battery.Voltage))
+		}
+		if sp.Battery.Percentage > 0 {
+			device.PowerModel.SetPercentage(float64(sp.Battery.Percentage))
+		}
+		if sp.Battery.SolarVoltage > 0 {
+			device.PowerModel.PinSolarVoltage(float64(sp.Battery.SolarVoltage))
+		}
+		device.updatePower()
+	}
+}
+
+func CreateFakeDevicesFromProfile(env *Environment, profile *Profile, basePort int, latitude, longitude float32) []*FakeDevice {
+	devices := make([]*FakeDevice, len(profile.Stations))
+	for i, station := range profile.Stations {
+		port := station.Port
+		if port == 0 {
+			port = PortFor(basePort, i)
+		}
+
+		devices[i] = NewFakeDevice(env, station.Name, port, latitude, longitude)
+
+		if station.TlsPort > 0 {
+			devices[i].TlsPort = station.TlsPort
+		}
+
+		station.Apply(devices[i])
+	}
+	return devices
+}
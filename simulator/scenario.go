@@ -0,0 +1,367 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	NetworkOffline = "offline"
+	NetworkOnline  = "online"
+)
+
+// ScenarioStep changes stations at a time after the scenario starts, measured
+// on the simulated clock. A step without a station applies to all of them.
+// Everything given is applied in the order of the fields, and Expect is
+// checked last.
+type ScenarioStep struct {
+	At          string           `yaml:"at" json:"at"`
+	Station     string           `yaml:"station" json:"station"`
+	Note        string           `yaml:"note" json:"note"`
+	Recording   *RecordingUpdate `yaml:"recording" json:"recording"`
+	Power       *PowerUpdate     `yaml:"power" json:"power"`
+	Gps         *GpsUpdate       `yaml:"gps" json:"gps"`
+	Firmware    *FirmwareUpdate  `yaml:"firmware" json:"firmware"`
+	Attach      *ModuleProfile   `yaml:"attach" json:"attach"`
+	Swap        *ModuleProfile   `yaml:"swap" json:"swap"`
+	Detach      *int             `yaml:"detach" json:"detach"`
+	Scan        bool             `yaml:"scan" json:"scan"`
+	Readings    *ReadingsRequest `yaml:"readings" json:"readings"`
+	ClearFaults bool             `yaml:"clear_faults" json:"clear_faults"`
+	Faults      []*FaultRule     `yaml:"faults" json:"faults"`
+	Network     string           `yaml:"network" json:"network"`
+	Reboot      bool             `yaml:"reboot" json:"reboot"`
+	Expect      *ScenarioExpect  `yaml:"expect" json:"expect"`
+	offset      time.Duration
+}
+
+// ScenarioExpect is checked against each of the step's stations, omitted
+// fields aren't checked.
+type ScenarioExpect struct {
+	Online            *bool   `yaml:"online" json:"online"`
+	Recording         *bool   `yaml:"recording" json:"recording"`
+	Modules           *int    `yaml:"modules" json:"modules"`
+	BatteryPercentage *uint32 `yaml:"battery_percentage" json:"battery_percentage"`
+	GpsFix            *uint32 `yaml:"gps_fix" json:"gps_fix"`
+	Firmware          *string `yaml:"firmware" json:"firmware"`
+	MinimumReadings   *uint64 `yaml:"minimum_readings" json:"minimum_readings"`
+}
+
+type Scenario struct {
+	Steps []*ScenarioStep `yaml:"steps" json:"steps"`
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading scenario: %v", err)
+	}
+
+	scenario := &Scenario{}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = unmarshalJsonStrict(data, scenario)
+	default:
+		err = yaml.UnmarshalStrict(data, scenario)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing scenario %s: %v", path, err)
+	}
+
+	if err := scenario.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %v", path, err)
+	}
+
+	log.Printf("Loaded scenario %s (%d steps)", path, len(scenario.Steps))
+
+	return scenario, nil
+}
+
+func (s *Scenario) Validate() error {
+	for i, step := range s.Steps {
+		if step == nil {
+			return fmt.Errorf("steps[%d]: empty step", i)
+		}
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("steps[%d].%v", i, err)
+		}
+	}
+
+	// Steps at the same time keep the order they were written in.
+	sort.SliceStable(s.Steps, func(i, j int) bool {
+		return s.Steps[i].offset < s.Steps[j].offset
+	})
+
+	return nil
+}
+
+func (step *ScenarioStep) validate() error {
+	if step.At != "" {
+		offset, err := time.ParseDuration(step.At)
+		if err != nil {
+			return fmt.Errorf("at: %v", err)
+		}
+		if offset < 0 {
+			return fmt.Errorf("at: %v is negative", step.At)
+		}
+		step.offset = offset
+	}
+
+	if step.Power != nil {
+		if err := step.Power.Validate(); err != nil {
+			return fmt.Errorf("power.%v", err)
+		}
+	}
+	if step.Gps != nil {
+		if err := step.Gps.Validate(); err != nil {
+			return fmt.Errorf("gps.%v", err)
+		}
+	}
+	if step.Firmware != nil {
+		if err := step.Firmware.Validate(); err != nil {
+			return fmt.Errorf("firmware.%v", err)
+		}
+	}
+	if step.Readings != nil {
+		if err := step.Readings.Validate(); err != nil {
+			return fmt.Errorf("readings.%v", err)
+		}
+	}
+
+	for _, mp := range []*ModuleProfile{step.Attach, step.Swap} {
+		if mp == nil {
+			continue
+		}
+		station := &StationProfile{
+			Modules: []*ModuleProfile{mp},
+		}
+		if err := station.validate(); err != nil {
+			return err
+		}
+	}
+
+	for i, rule := range step.Faults {
+		if rule == nil {
+			return fmt.Errorf("faults[%d]: empty rule", i)
+		}
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("faults[%d].%v", i, err)
+		}
+	}
+
+	if step.Network != "" && step.Network != NetworkOffline && step.Network != NetworkOnline {
+		return fmt.Errorf("network: %q should be %s or %s", step.Network, NetworkOffline, NetworkOnline)
+	}
+
+	return nil
+}
+
+// ScenarioRunner plays a scenario against running stations. The hooks are
+// optional, OnStep is called before each step and OnFailure for every step
+// that couldn't be applied or whose expectations weren't met.
+type ScenarioRunner struct {
+	Stations  *Stations
+	OnStep    func(step *ScenarioStep)
+	OnFailure func(step *ScenarioStep, station string, err error)
+	failures  int
+}
+
+func NewScenarioRunner(stations *Stations) *ScenarioRunner {
+	return &ScenarioRunner{
+		Stations: stations,
+	}
+}
+
+// Run plays the steps in order, returning once the last one is done or ctx
+// is. The error says how many steps failed.
+func (sr *ScenarioRunner) Run(ctx context.Context, scenario *Scenario) error {
+	clock := sr.Stations.env.Clock
+	started := clock.Now()
+
+	for _, step := range scenario.Steps {
+		if wait := started.Add(step.offset).Sub(clock.Now()); wait > 0 {
+			timer := clock.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+
+		if sr.OnStep != nil {
+			sr.OnStep(step)
+		}
+
+		sr.run(step)
+	}
+
+	if sr.failures > 0 {
+		return fmt.Errorf("scenario had %d failures", sr.failures)
+	}
+
+	log.Printf("Scenario done")
+
+	return nil
+}
+
+func (sr *ScenarioRunner) fail(step *ScenarioStep, station string, err error) {
+	sr.failures += 1
+	log.Printf("Scenario (%v) %s: FAILED %v", step.offset, station, err)
+	if sr.OnFailure != nil {
+		sr.OnFailure(step, station, err)
+	}
+}
+
+func (sr *ScenarioRunner) run(step *ScenarioStep) {
+	if step.Note != "" {
+		log.Printf("Scenario (%v) %s", step.offset, step.Note)
+	}
+
+	faults := sr.Stations.env.Faults
+	if step.ClearFaults {
+		faults.SetRules(make([]*FaultRule, 0))
+	}
+	for _, rule := range step.Faults {
+		added := *rule
+		if added.Device == "" {
+			added.Device = step.Station
+		}
+		if err := faults.AddRule(&added); err != nil {
+			sr.fail(step, step.Station, err)
+		}
+	}
+
+	devices := sr.Stations.All()
+	if step.Station != "" {
+		device := sr.Stations.Find(step.Station)
+		if device == nil {
+			sr.fail(step, step.Station, fmt.Errorf("no station named %q", step.Station))
+			return
+		}
+		devices = []*FakeDevice{device}
+	}
+
+	for _, device := range devices {
+		if err := sr.apply(step, device); err != nil {
+			sr.fail(step, device.Name, err)
+			continue
+		}
+		if step.Expect != nil {
+			device.lock.Lock()
+			err := step.Expect.check(device)
+			device.lock.Unlock()
+			if err != nil {
+				sr.fail(step, device.Name, err)
+			}
+		}
+	}
+}
+
+func (sr *ScenarioRunner) apply(step *ScenarioStep, device *FakeDevice) error {
+	device.lock.Lock()
+	err := step.applyLocked(device)
+	device.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	switch step.Network {
+	case NetworkOffline:
+		device.Stop()
+	case NetworkOnline:
+		if err := device.Start(sr.Stations.dispatcher); err != nil {
+			return err
+		}
+	}
+
+	if step.Reboot {
+		device.Reboot()
+	}
+
+	return nil
+}
+
+func (step *ScenarioStep) applyLocked(device *FakeDevice) error {
+	if step.Recording != nil {
+		step.Recording.Apply(device)
+	}
+	if step.Power != nil {
+		step.Power.Apply(device)
+	}
+	if step.Gps != nil {
+		step.Gps.Apply(device)
+	}
+	if step.Firmware != nil {
+		step.Firmware.Apply(device)
+	}
+	if step.Attach != nil {
+		if err := device.AttachModule(step.Attach.toModule(device)); err != nil {
+			return err
+		}
+	}
+	if step.Swap != nil {
+		if err := device.SwapModule(step.Swap.toModule(device)); err != nil {
+			return err
+		}
+	}
+	if step.Detach != nil {
+		if err := device.DetachModule(*step.Detach); err != nil {
+			return err
+		}
+	}
+	if step.Scan {
+		device.ScanModules()
+	}
+	if step.Readings != nil {
+		step.Readings.Apply(device)
+	}
+	return nil
+}
+
+// check compares the expectations to the device, the caller holds the lock.
+func (e *ScenarioExpect) check(device *FakeDevice) error {
+	device.updatePower()
+	device.updateGps()
+
+	failures := make([]string, 0)
+
+	if e.Online != nil && device.online != *e.Online {
+		failures = append(failures, fmt.Sprintf("online is %v, expected %v", device.online, *e.Online))
+	}
+	if e.Recording != nil && device.State.Recording != *e.Recording {
+		failures = append(failures, fmt.Sprintf("recording is %v, expected %v", device.State.Recording, *e.Recording))
+	}
+	if e.Modules != nil && len(device.Modules) != *e.Modules {
+		failures = append(failures, fmt.Sprintf("modules is %d, expected %d", len(device.Modules), *e.Modules))
+	}
+	if e.BatteryPercentage != nil && device.Power.Battery.Percentage != *e.BatteryPercentage {
+		failures = append(failures, fmt.Sprintf("battery_percentage is %d, expected %d", device.Power.Battery.Percentage, *e.BatteryPercentage))
+	}
+	if e.GpsFix != nil && device.Gps.Fix != *e.GpsFix {
+		failures = append(failures, fmt.Sprintf("gps_fix is %d, expected %d", device.Gps.Fix, *e.GpsFix))
+	}
+	if e.Firmware != nil && device.Firmware.Version != *e.Firmware {
+		failures = append(failures, fmt.Sprintf("firmware is %q, expected %q", device.Firmware.Version, *e.Firmware))
+	}
+	if e.MinimumReadings != nil {
+		if readings := device.State.Streams[0].Status().Record; readings < *e.MinimumReadings {
+			failures = append(failures, fmt.Sprintf("readings is %d, expected at least %d", readings, *e.MinimumReadings))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package simulator
+
+import (
+	"time"
+
+	pb "github.com/fieldkit/app-protocol"
+)
+
+const (
+	SecondsPerDay = 86400
+)
+
+// NextReadingTime returns the first time at or after now that the schedule
+// calls for a reading, the way the firmware does. Intervals are windows of the
+// day, in seconds since midnight, each with their own interval and aligned to
+// the start of the window. Without any windows the whole day is used with the
+// schedule's own interval.
+func NextReadingTime(schedule *pb.Schedule, now time.Time) (time.Time, bool) {
+	if schedule == nil {
+		return time.Time{}, false
+	}
+
+	intervals := schedule.Intervals
+	if len(intervals) == 0 {
+		intervals = []*pb.Interval{
+			&pb.Interval{
+				Start:    0,
+				End:      SecondsPerDay,
+				Interval: schedule.Interval,
+			},
+		}
+	}
+
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	found := false
+	next := time.Time{}
+
+	for day := 0; day < 2; day += 1 {
+		midnight := today.AddDate(0, 0, day)
+		for _, window := range intervals {
+			interval := int64(window.Interval)
+			if interval == 0 {
+				interval = int64(schedule.Interval)
+			}
+			if interval == 0 || window.End <= window.Start {
+				continue
+			}
+
+			start := midnight.Add(time.Duration(window.Start) * time.Second)
+			end := midnight.Add(time.Duration(window.End) * time.Second)
+
+			candidate := start
+			if now.After(start) {
+				elapsed := int64(now.Sub(start) / time.Second)
+				steps := (elapsed + interval - 1) / interval
+				candidate = start.Add(time.Duration(steps*interval) * time.Second)
+				if candidate.Before(now) {
+					candidate = candidate.Add(time.Duration(interval) * time.Second)
+				}
+			}
+
+			if !candidate.Before(end) {
+				continue
+			}
+
+			if !found || candidate.Before(next) {
+				next = candidate
+				found = true
+			}
+		}
+		if found {
+			return next, true
+		}
+	}
+
+	return next, found
+}
@@ -0,0 +1,229 @@
+package simulator
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	pbatlas "github.com/fieldkit/atlas-protocol"
+)
+
+const (
+	MaximumSimulationSteps = 60 * 24
+)
+
+// Signal produces the value of a single sensor over time. Implementations
+// should return the same value when sampled repeatedly at the same instant so
+// that live readings and stored records agree.
+type Signal interface {
+	Sample(now time.Time) float32
+}
+
+// SignalParameters describes a sensor signal as the sum of a diurnal curve, a
+// linear drift, a random walk and step changes, with occasional spikes and
+// dropouts layered on top. Chances are per minute of simulated time.
+type SignalParameters struct {
+	Seed          int64   `yaml:"seed" json:"seed"`
+	Base          float64 `yaml:"base" json:"base"`
+	Amplitude     float64 `yaml:"amplitude" json:"amplitude"`
+	PeakHour      float64 `yaml:"peak_hour" json:"peak_hour"`
+	Drift         float64 `yaml:"drift" json:"drift"`
+	Walk          float64 `yaml:"walk" json:"walk"`
+	Noise         float64 `yaml:"noise" json:"noise"`
+	StepChance    float64 `yaml:"step_chance" json:"step_chance"`
+	StepSize      float64 `yaml:"step_size" json:"step_size"`
+	SpikeChance   float64 `yaml:"spike_chance" json:"spike_chance"`
+	SpikeSize     float64 `yaml:"spike_size" json:"spike_size"`
+	DropoutChance float64 `yaml:"dropout_chance" json:"dropout_chance"`
+	Minimum       float64 `yaml:"minimum" json:"minimum"`
+	Maximum       float64 `yaml:"maximum" json:"maximum"`
+}
+
+var defaultSignalParameters = map[pbatlas.SensorType]SignalParameters{
+	pbatlas.SensorType_SENSOR_TEMP: SignalParameters{
+		Base:      18.0,
+		Amplitude: 4.0,
+		PeakHour:  15,
+		Walk:      0.02,
+		Noise:     0.05,
+		Minimum:   -5.0,
+		Maximum:   40.0,
+	},
+	pbatlas.SensorType_SENSOR_PH: SignalParameters{
+		Base:      7.2,
+		Amplitude: 0.2,
+		PeakHour:  16,
+		Walk:      0.005,
+		Noise:     0.01,
+		Minimum:   0.0,
+		Maximum:   14.0,
+	},
+	pbatlas.SensorType_SENSOR_EC: SignalParameters{
+		Base:        450.0,
+		Amplitude:   20.0,
+		PeakHour:    14,
+		Walk:        1.0,
+		Noise:       2.0,
+		SpikeChance: 0.002,
+		SpikeSize:   300.0,
+		Minimum:     0.0,
+		Maximum:     10000.0,
+	},
+	pbatlas.SensorType_SENSOR_DO: SignalParameters{
+		Base:      8.0,
+		Amplitude: 1.5,
+		PeakHour:  14,
+		Walk:      0.01,
+		Noise:     0.05,
+		Minimum:   0.0,
+		Maximum:   20.0,
+	},
+	pbatlas.SensorType_SENSOR_ORP: SignalParameters{
+		Base:       200.0,
+		Drift:      -0.05,
+		Walk:       0.5,
+		Noise:      1.0,
+		StepChance: 0.0005,
+		StepSize:   25.0,
+		Minimum:    -500.0,
+		Maximum:    500.0,
+	},
+}
+
+// enclosureSignalParameters is the temperature inside the station's enclosure,
+// which the sun warms more than the water.
+var enclosureSignalParameters = SignalParameters{
+	Base:      22.0,
+	Amplitude: 8.0,
+	PeakHour:  14,
+	Walk:      0.02,
+	Noise:     0.1,
+	Minimum:   -10.0,
+	Maximum:   60.0,
+}
+
+type SimulatedSignal struct {
+	lock    sync.Mutex
+	params  SignalParameters
+	rng     *rand.Rand
+	started time.Time
+	last    time.Time
+	walked  time.Time
+	walk    float64
+	steps   float64
+	value   float32
+}
+
+func NewSimulatedSignal(params SignalParameters) *SimulatedSignal {
+	return &SimulatedSignal{
+		params: params,
+		rng:    rand.New(rand.NewSource(params.Seed)),
+	}
+}
+
+func NewDefaultSignal(sensorType pbatlas.SensorType, seed int64) *SimulatedSignal {
+	params := defaultSignalParameters[sensorType]
+	params.Seed = seed
+	return NewSimulatedSignal(params)
+}
+
+func NewEnclosureSignal(seed int64) *SimulatedSignal {
+	params := enclosureSignalParameters
+	params.Seed = seed
+	return NewSimulatedSignal(params)
+}
+
+func SeedFromKey(key string) int64 {
+	hasher := sha1.New()
+	hasher.Write([]byte(key))
+	return int64(binary.BigEndian.Uint64(hasher.Sum(nil)))
+}
+
+func (s *SimulatedSignal) advance(minutes int64) {
+	p := &s.params
+	if minutes > MaximumSimulationSteps {
+		s.walk += s.rng.NormFloat64() * p.Walk * math.Sqrt(float64(minutes))
+		if p.StepChance > 0 && s.rng.Float64() < p.StepChance*float64(minutes) {
+			s.steps += (s.rng.Float64()*2 - 1) * p.StepSize
+		}
+		return
+	}
+	for i := int64(0); i < minutes; i += 1 {
+		s.walk += s.rng.NormFloat64() * p.Walk
+		if p.StepChance > 0 && s.rng.Float64() < p.StepChance {
+			s.steps += (s.rng.Float64()*2 - 1) * p.StepSize
+		}
+	}
+}
+
+func (s *SimulatedSignal) Sample(now time.Time) float32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p := &s.params
+
+	if s.last.IsZero() {
+		s.started = now
+		s.walked = now
+	} else {
+		if !now.After(s.last) {
+			return s.value
+		}
+		// Only whole minutes are walked, the rest is left for next time.
+		minutes := int64(now.Sub(s.walked) / time.Minute)
+		s.advance(minutes)
+		s.walked = s.walked.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	s.last = now
+
+	// Noise comes from the time rather than the walk's generator, so readings
+	// don't depend on how often the signal was sampled in between.
+	noise := rand.New(rand.NewSource(p.Seed + now.Unix()/60))
+
+	if p.DropoutChance > 0 && noise.Float64() < p.DropoutChance {
+		s.value = float32(math.NaN())
+		return s.value
+	}
+
+	hour := float64(now.Hour()) + float64(now.Minute())/60.0
+	diurnal := p.Amplitude * math.Cos(2*math.Pi*(hour-p.PeakHour)/24.0)
+	drift := p.Drift * now.Sub(s.started).Hours()
+	value := p.Base + diurnal + drift + s.walk + s.steps + noise.NormFloat64()*p.Noise
+
+	if p.SpikeChance > 0 && noise.Float64() < p.SpikeChance {
+		value += p.SpikeSize
+	}
+
+	if p.Maximum > p.Minimum {
+		value = math.Max(p.Minimum, math.Min(p.Maximum, value))
+	}
+
+	s.value = float32(value)
+
+	return s.value
+}
+
+func (p *SignalParameters) Validate() error {
+	chances := map[string]float64{
+		"step_chance":    p.StepChance,
+		"spike_chance":   p.SpikeChance,
+		"dropout_chance": p.DropoutChance,
+	}
+	for name, chance := range chances {
+		if chance < 0 || chance > 1 {
+			return fmt.Errorf("%s: %v is out of range (0-1)", name, chance)
+		}
+	}
+	if p.Maximum < p.Minimum {
+		return fmt.Errorf("maximum: %v is less than minimum %v", p.Maximum, p.Minimum)
+	}
+	if p.PeakHour < 0 || p.PeakHour >= 24 {
+		return fmt.Errorf("peak_hour: %v is out of range (0-24)", p.PeakHour)
+	}
+	return nil
+}
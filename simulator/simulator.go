@@ -0,0 +1,183 @@
+package simulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Options describes a set of stations to simulate. The zero value runs one
+// station with the default modules on an ephemeral port, writing its files to
+// a temporary directory that's removed on Close, without announcing it on the
+// network. A RebootDuration of 0 is DefaultRebootDuration.
+type Options struct {
+	Names           []string
+	Profile         *Profile
+	NoModules       bool
+	PrimeReadings   int
+	Seed            int64
+	Clock           Clock
+	Latitude        float32
+	Longitude       float32
+	BasePort        int
+	Bind            string
+	Directory       string
+	Announce        bool
+	ZeroConf        ZeroConfOptions
+	Reset           bool
+	RebootDuration  time.Duration
+	FirmwareFailure string
+	Faults          []*FaultRule
+}
+
+// Simulator runs fake stations in process, so that tests can talk to them
+// over HTTP like they would real hardware.
+type Simulator struct {
+	Environment *Environment
+	Dispatcher  *Dispatcher
+	Stations    *Stations
+	temporary   string
+}
+
+func NewSimulator(o Options) (*Simulator, error) {
+	if err := ValidateFirmwareFailure(o.FirmwareFailure); err != nil {
+		return nil, err
+	}
+
+	clock := o.Clock
+	if clock == nil {
+		clock = &SystemClock{}
+	}
+
+	directory := o.Directory
+	temporary := ""
+	if directory == "" {
+		dir, err := ioutil.TempDir("", "fk-simulator")
+		if err != nil {
+			return nil, err
+		}
+		directory, temporary = dir, dir
+	}
+
+	// Nothing is left behind when the stations can't be created.
+	ok := false
+	defer func() {
+		if !ok && temporary != "" {
+			os.RemoveAll(temporary)
+		}
+	}()
+
+	env := NewEnvironment(o.Seed, clock)
+	env.Directory = directory
+	env.Announce = o.Announce
+	env.ZeroConf = o.ZeroConf
+
+	for i, rule := range o.Faults {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("faults[%d].%v", i, err)
+		}
+	}
+
+	if len(o.Faults) > 0 {
+		env.Faults.SetRules(o.Faults)
+	}
+
+	var devices []*FakeDevice
+
+	if o.Profile != nil {
+		if err := o.Profile.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid profile: %v", err)
+		}
+
+		devices = CreateFakeDevicesFromProfile(env, o.Profile, o.BasePort, o.Latitude, o.Longitude)
+	} else {
+		names := o.Names
+		if len(names) == 0 {
+			names = []string{"fake0"}
+		}
+
+		devices = CreateFakeDevicesNamed(env, names, o.NoModules, o.BasePort, o.Latitude, o.Longitude)
+	}
+
+	for _, device := range devices {
+		if o.RebootDuration > 0 {
+			device.RebootDuration = o.RebootDuration
+		}
+		device.FirmwareFailure = o.FirmwareFailure
+		device.Bind = o.Bind
+
+		if o.Reset {
+			if err := device.ResetState(); err != nil {
+				return nil, err
+			}
+		} else {
+			if _, err := device.RestoreState(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if o.PrimeReadings > 0 {
+		for _, device := range devices {
+			for _, stream := range device.State.Streams {
+				if err := stream.Open(); err != nil {
+					return nil, err
+				}
+			}
+
+			device.State.Streams[1].AppendConfiguration(device)
+
+			device.PrimeReadings(o.PrimeReadings)
+		}
+	}
+
+	dispatcher := NewStationDispatcher()
+
+	stations := NewStations(env, dispatcher, o.BasePort, o.Bind)
+
+	for _, device := range devices {
+		if err := stations.Add(device); err != nil {
+			stations.Close()
+			return nil, err
+		}
+	}
+
+	ok = true
+
+	return &Simulator{
+		Environment: env,
+		Dispatcher:  dispatcher,
+		Stations:    stations,
+		temporary:   temporary,
+	}, nil
+}
+
+// BaseUrls returns the URL of each station's API, in the order they were
+// created.
+func (s *Simulator) BaseUrls() []string {
+	urls := make([]string, 0)
+	for _, device := range s.Stations.All() {
+		device.lock.Lock()
+		urls = append(urls, device.BaseUrl())
+		device.lock.Unlock()
+	}
+	return urls
+}
+
+func (s *Simulator) BaseUrl(name string) (string, error) {
+	device := s.Stations.Find(name)
+	if device == nil {
+		return "", fmt.Errorf("no station named %q", name)
+	}
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	return device.BaseUrl(), nil
+}
+
+func (s *Simulator) Close() {
+	s.Stations.Close()
+	if s.temporary != "" {
+		os.RemoveAll(s.temporary)
+	}
+}
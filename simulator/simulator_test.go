@@ -0,0 +1,133 @@
+package simulator
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSimulatorDefaults(t *testing.T) {
+	sim, err := NewSimulator(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := sim.Environment.Directory
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("expected a temporary directory: %v", err)
+	}
+
+	for _, device := range sim.Stations.All() {
+		if device.RebootDuration != DefaultRebootDuration {
+			t.Errorf("expected a reboot duration of %v, got %v", DefaultRebootDuration, device.RebootDuration)
+		}
+	}
+
+	sim.Close()
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", dir)
+	}
+}
+
+const hammerDuration = 2 * time.Second
+
+// hammer calls f over and over from a few goroutines until the duration is
+// up, for the race detector to watch.
+func hammer(wg *sync.WaitGroup, stop <-chan bool, f func()) {
+	for i := 0; i < 4; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					f()
+				}
+			}
+		}()
+	}
+}
+
+func drain(res *http.Response, err error) {
+	if err == nil {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+}
+
+// Run with -race, stations are queried, downloaded from, upgraded and rebooted
+// while they take readings.
+func TestSimulatorConcurrentRequests(t *testing.T) {
+	sim, err := NewSimulator(Options{
+		Names:          []string{"race0", "race1"},
+		Clock:          NewScaledClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), 0),
+		Reset:          true,
+		PrimeReadings:  10,
+		RebootDuration: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sim.Close()
+
+	for _, device := range sim.Stations.All() {
+		device.lock.Lock()
+		device.SetRecording(true)
+		device.lock.Unlock()
+	}
+
+	client := &http.Client{
+		Timeout: time.Second,
+	}
+
+	stop := make(chan bool)
+	wg := &sync.WaitGroup{}
+
+	hammer(wg, stop, func() {
+		for _, url := range sim.BaseUrls() {
+			drain(client.Post(url, "application/octet-stream", nil))
+		}
+	})
+	hammer(wg, stop, func() {
+		for _, url := range sim.BaseUrls() {
+			drain(client.Get(url + "/download/data"))
+			drain(client.Get(url + "/logs.txt"))
+		}
+	})
+	hammer(wg, stop, func() {
+		for _, url := range sim.BaseUrls() {
+			image := bytes.NewReader(make([]byte, 4096))
+			drain(client.Post(url+"/upload/firmware", "application/octet-stream", image))
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	hammer(wg, stop, func() {
+		failure := FirmwareFailureNone
+		for _, device := range sim.Stations.All() {
+			device.lock.Lock()
+			(&FirmwareUpdate{Failure: &failure}).Apply(device)
+			device.lock.Unlock()
+		}
+		sim.Stations.NextPort()
+		sim.Stations.Manifest()
+	})
+
+	time.Sleep(hammerDuration)
+	close(stop)
+	wg.Wait()
+
+	for _, device := range sim.Stations.All() {
+		if status := device.State.Streams[0].Status(); status.Record <= 10 {
+			t.Errorf("%s took no readings, has %d records", device.Name, status.Record)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	pb "github.com/fieldkit/app-protocol"
+)
+
+// SavedModule is a module as it's stored in the state file.
+type SavedModule struct {
+	Position      int    `json:"position"`
+	Sensor        string `json:"sensor"`
+	Configuration []byte `json:"configuration"`
+	Generation    uint32 `json:"generation,omitempty"`
+}
+
+type SavedSchedules struct {
+	Readings *pb.Schedule `json:"readings"`
+	Lora     *pb.Schedule `json:"lora"`
+	Network  *pb.Schedule `json:"network"`
+	Gps      *pb.Schedule `json:"gps"`
+}
+
+// SavedState is everything a real station keeps in flash across restarts,
+// the streams are kept in their own files.
+type SavedState struct {
+	Name         string            `json:"name"`
+	Device       string            `json:"device"`
+	Networks     []*pb.NetworkInfo `json:"networks"`
+	Lora         *pb.LoraSettings  `json:"lora"`
+	Schedules    *SavedSchedules   `json:"schedules"`
+	Modules      []*SavedModule    `json:"modules"`
+	Recording    bool              `json:"recording"`
+	StartedTime  uint64            `json:"started_time"`
+	Latitude     float32           `json:"latitude"`
+	Longitude    float32           `json:"longitude"`
+	HaveLocation bool              `json:"have_location"`
+	Fixed        bool              `json:"fixed_location"`
+	Firmware     *pb.Firmware      `json:"firmware"`
+	FirmwareSize uint32            `json:"firmware_size,omitempty"`
+	Generation   uint32            `json:"module_generation"`
+}
+
+func (fd *FakeDevice) StateFile() string {
+	return fd.Environment.Path(fmt.Sprintf("%s-state.json", fd.Name))
+}
+
+func (fd *FakeDevice) makeSavedState() *SavedState {
+	// The bus is saved, as that's what the station finds when it boots.
+	modules := make([]*SavedModule, 0)
+	for _, m := range fd.Bus() {
+		modules = append(modules, &SavedModule{
+			Position:      m.Position,
+			Sensor:        SensorTypeName(m.SensorType),
+			Configuration: m.Configuration,
+			Generation:    m.Generation,
+		})
+	}
+
+	return &SavedState{
+		Name:     fd.State.Identity.Name,
+		Device:   fd.State.Identity.Device,
+		Networks: fd.State.Networks,
+		Lora:     fd.State.Lora,
+		Schedules: &SavedSchedules{
+			Readings: fd.ReadingsSchedule,
+			Lora:     fd.LoraSchedule,
+			Network:  fd.NetworkSchedule,
+			Gps:      fd.GpsSchedule,
+		},
+		Modules:      modules,
+		Recording:    fd.State.Recording,
+		StartedTime:  fd.State.StartedTime,
+		Latitude:     fd.Latitude,
+		Longitude:    fd.Longitude,
+		HaveLocation: fd.HaveLocation,
+		Fixed:        fd.GpsModel.Fixed(),
+		Firmware:     fd.Firmware,
+		FirmwareSize: fd.FirmwareSize,
+		Generation:   fd.ModuleGeneration,
+	}
+}
+
+// SaveState writes the device's state, replacing the previous file in one
+// step so a crash never leaves half of it behind. The caller holds the
+// device's lock, failures are only logged like the real firmware would.
+func (fd *FakeDevice) SaveState() {
+	data, err := json.MarshalIndent(fd.makeSavedState(), "", "  ")
+	if err != nil {
+		log.Printf("%s: error saving state: %v", fd.Name, err)
+		return
+	}
+
+	temporary := fd.StateFile() + ".tmp"
+	if err := writeFileSynced(temporary, data); err != nil {
+		log.Printf("%s: error saving state: %v", fd.Name, err)
+		return
+	}
+
+	if err := os.Rename(temporary, fd.StateFile()); err != nil {
+		log.Printf("%s: error saving state: %v", fd.Name, err)
+	}
+}
+
+// RestoreState applies a previously saved state over the device's defaults,
+// returning false when there's nothing saved.
+func (fd *FakeDevice) RestoreState() (bool, error) {
+	data, err := readFileIfExists(fd.StateFile())
+	if err != nil {
+		return false, err
+	}
+
+	if len(data) == 0 {
+		return false, nil
+	}
+
+	saved := &SavedState{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		return false, fmt.Errorf("parsing %s: %v", fd.StateFile(), err)
+	}
+
+	modules := make([]*FakeModule, 0)
+	for _, sm := range saved.Modules {
+		sensorType, err := ParseSensorType(sm.Sensor)
+		if err != nil {
+			return false, fmt.Errorf("parsing %s: %v", fd.StateFile(), err)
+		}
+
+		// Keep existing modules so their simulation settings survive.
+		module := fd.ModuleAt(sm.Position)
+		if module == nil || module.SensorType != sensorType || module.Generation != sm.Generation {
+			module = NewFakeModule(fd.Environment, fd.Name, sm.Position, sensorType)
+			module.setGeneration(fd, sm.Generation)
+		}
+		if err := module.Configure(sm.Configuration, 0); err != nil {
+			log.Printf("%s: module %d: %v", fd.Name, sm.Position, err)
+			module.Configuration = sm.Configuration
+		}
+
+		modules = append(modules, module)
+	}
+
+	fd.Modules = modules
+	fd.ModuleGeneration = saved.Generation
+	fd.attached = nil
+	fd.State.Identity.Name = saved.Name
+	fd.State.Identity.Device = saved.Device
+	fd.State.Networks = saved.Networks
+	fd.State.Recording = saved.Recording
+	fd.State.StartedTime = saved.StartedTime
+	fd.Latitude = saved.Latitude
+	fd.Longitude = saved.Longitude
+	fd.HaveLocation = saved.HaveLocation
+	fd.GpsModel.SetFixed(saved.Fixed)
+
+	if saved.Networks == nil {
+		fd.State.Networks = make([]*pb.NetworkInfo, 0)
+	}
+	if saved.Lora != nil {
+		fd.State.Lora = saved.Lora
+	}
+	if saved.Firmware != nil {
+		fd.Firmware = saved.Firmware
+	}
+	if saved.FirmwareSize > 0 {
+		fd.FirmwareSize = saved.FirmwareSize
+	}
+	if saved.Schedules != nil {
+		if saved.Schedules.Readings != nil {
+			fd.ReadingsSchedule = saved.Schedules.Readings
+		}
+		if saved.Schedules.Lora != nil {
+			fd.LoraSchedule = saved.Schedules.Lora
+		}
+		if saved.Schedules.Network != nil {
+			fd.NetworkSchedule = saved.Schedules.Network
+		}
+		if saved.Schedules.Gps != nil {
+			fd.GpsSchedule = saved.Schedules.Gps
+		}
+	}
+
+	log.Printf("%s: restored state from %s", fd.Name, fd.StateFile())
+
+	return true, nil
+}
+
+func (fd *FakeDevice) ResetState() error {
+	if err := os.Remove(fd.StateFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	log.Printf("%s: reset state", fd.Name)
+
+	return nil
+}
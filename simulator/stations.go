@@ -0,0 +1,204 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	BasePort      = 2380
+	TlsPortOffset = 1000
+)
+
+// PortFor is the port of the i-th station, a base port of 0 means ephemeral
+// ports chosen when the stations start.
+func PortFor(basePort int, i int) int {
+	if basePort == 0 {
+		return 0
+	}
+	return basePort + i
+}
+
+// Stations is the set of running fake devices, which can change at runtime.
+type Stations struct {
+	lock       sync.Mutex
+	env        *Environment
+	dispatcher *Dispatcher
+	basePort   int
+	bind       string
+	devices    []*FakeDevice
+	readings   sync.WaitGroup
+}
+
+func NewStations(env *Environment, dispatcher *Dispatcher, basePort int, bind string) *Stations {
+	return &Stations{
+		env:        env,
+		dispatcher: dispatcher,
+		basePort:   basePort,
+		bind:       bind,
+		devices:    make([]*FakeDevice, 0),
+	}
+}
+
+func (s *Stations) Add(device *FakeDevice) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	port := device.HttpPort()
+	for _, existing := range s.devices {
+		if existing.Name == device.Name {
+			return fmt.Errorf("station %q already exists", device.Name)
+		}
+		if port != 0 && existing.HttpPort() == port {
+			return fmt.Errorf("port %d is already used by %q", port, existing.Name)
+		}
+	}
+
+	if err := device.Start(s.dispatcher); err != nil {
+		return err
+	}
+
+	s.readings.Add(2)
+	go func() {
+		defer s.readings.Done()
+		device.FakeReadings()
+	}()
+	go func() {
+		defer s.readings.Done()
+		device.SimulatePower()
+	}()
+
+	s.devices = append(s.devices, device)
+
+	log.Printf("%s added", device.Name)
+
+	return nil
+}
+
+func (s *Stations) Remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, device := range s.devices {
+		if device.Name == name {
+			device.Close()
+			s.devices = append(s.devices[:i], s.devices[i+1:]...)
+			log.Printf("%s removed", name)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no station named %q", name)
+}
+
+func (s *Stations) Find(name string) *FakeDevice {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, device := range s.devices {
+		if device.Name == name {
+			return device
+		}
+	}
+
+	return nil
+}
+
+func (s *Stations) All() []*FakeDevice {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	devices := make([]*FakeDevice, len(s.devices))
+	copy(devices, s.devices)
+	return devices
+}
+
+// NextPort returns a port after every station's, for adding stations.
+func (s *Stations) NextPort() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.basePort == 0 {
+		return 0
+	}
+
+	port := s.basePort
+	for _, device := range s.devices {
+		if used := device.HttpPort(); used >= port {
+			port = used + 1
+		}
+	}
+	return port
+}
+
+func (s *Stations) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, device := range s.devices {
+		device.Close()
+	}
+
+	s.devices = make([]*FakeDevice, 0)
+
+	s.readings.Wait()
+}
+
+// ManifestEntry tells other processes where a station can be reached, which
+// matters when ports are ephemeral.
+type ManifestEntry struct {
+	Name     string `json:"name"`
+	DeviceId string `json:"device_id"`
+	Bind     string `json:"bind"`
+	Port     int    `json:"port"`
+	TlsPort  int    `json:"tls_port"`
+	Url      string `json:"url"`
+}
+
+type Manifest struct {
+	Stations []*ManifestEntry `json:"stations"`
+}
+
+func (s *Stations) Manifest() *Manifest {
+	manifest := &Manifest{
+		Stations: make([]*ManifestEntry, 0),
+	}
+
+	for _, device := range s.All() {
+		device.lock.Lock()
+		manifest.Stations = append(manifest.Stations, &ManifestEntry{
+			Name:     device.Name,
+			DeviceId: device.DeviceId,
+			Bind:     device.Bind,
+			Port:     device.Port,
+			TlsPort:  device.TlsPort,
+			Url:      device.BaseUrl(),
+		})
+		device.lock.Unlock()
+	}
+
+	return manifest
+}
+
+func (s *Stations) WriteManifest(path string) error {
+	data, err := json.MarshalIndent(s.Manifest(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temporary := path + ".tmp"
+	if err := writeFileSynced(temporary, data); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temporary, path); err != nil {
+		return err
+	}
+
+	log.Printf("Wrote manifest %s", path)
+
+	return nil
+}
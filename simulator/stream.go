@@ -0,0 +1,475 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	RecordHeaderSize = 12
+	IndexEntrySize   = 28
+)
+
+type RecordHeader struct {
+	Size   uint32
+	Record uint64
+}
+
+// IndexEntry locates a single record in a stream file. Offset is where the
+// record's header begins in the file and Position is the number of body bytes
+// that precede the record, which is what the firmware reports as positions.
+type IndexEntry struct {
+	Record   uint64
+	Offset   uint64
+	Position uint64
+	Size     uint32
+}
+
+// StreamState is an append only file of length prefixed records along with a
+// sidecar index of where each record begins, so that lookups don't have to
+// scan the file. The index is rebuilt from the file when it's missing or
+// behind and partially written records at the end of the file are discarded.
+type StreamState struct {
+	Time     uint64
+	Size     uint64
+	Version  uint32
+	Record   uint64
+	File     string
+	lock     sync.Mutex
+	opened   bool
+	index    []IndexEntry
+	length   uint64
+	lastHash []byte
+}
+
+// StreamStatus is a consistent copy of a stream's metadata.
+type StreamStatus struct {
+	Time    uint64
+	Size    uint64
+	Version uint32
+	Record  uint64
+}
+
+func (ss *StreamState) Status() StreamStatus {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	return StreamStatus{
+		Time:    ss.Time,
+		Size:    ss.Size,
+		Version: ss.Version,
+		Record:  ss.Record,
+	}
+}
+
+func (ss *StreamState) IndexFile() string {
+	return ss.File + ".idx"
+}
+
+func (ss *StreamState) Open() error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	return ss.open()
+}
+
+func (ss *StreamState) open() error {
+	if ss.opened {
+		return nil
+	}
+
+	clean, err := ss.loadIndex()
+	if err != nil {
+		return err
+	}
+
+	if err := ss.recoverTail(clean); err != nil {
+		return err
+	}
+
+	ss.opened = true
+
+	log.Printf("Opened %s (#%d) (%d bytes) (%d indexed)", ss.File, ss.Record, ss.Size, len(ss.index))
+
+	return nil
+}
+
+// Loads the index, returning false if any of it had to be discarded.
+func (ss *StreamState) loadIndex() (bool, error) {
+	ss.index = make([]IndexEntry, 0)
+
+	data, err := readFileIfExists(ss.IndexFile())
+	if err != nil {
+		return false, err
+	}
+
+	stat, err := statFileIfExists(ss.File)
+	if err != nil {
+		return false, err
+	}
+
+	reader := bytes.NewReader(data)
+	for reader.Len() >= IndexEntrySize {
+		entry := IndexEntry{}
+		if err := binary.Read(reader, binary.BigEndian, &entry); err != nil {
+			return false, err
+		}
+
+		// Only trust entries that describe records completely on disk and
+		// that follow on from the previous one.
+		if entry.Offset+RecordHeaderSize+uint64(entry.Size) > stat {
+			break
+		}
+		if len(ss.index) > 0 {
+			previous := ss.index[len(ss.index)-1]
+			if entry.Offset != previous.Offset+RecordHeaderSize+uint64(previous.Size) || entry.Record <= previous.Record {
+				break
+			}
+		} else if entry.Offset != 0 {
+			break
+		}
+
+		ss.index = append(ss.index, entry)
+	}
+
+	// An index left over from another file can still fit inside this one,
+	// the last entry has to match the record that's really there.
+	if len(ss.index) > 0 {
+		matches, err := ss.headerMatches(ss.index[len(ss.index)-1])
+		if err != nil {
+			return false, err
+		}
+		if !matches {
+			log.Printf("%s: stale index, rebuilding", ss.File)
+			ss.index = make([]IndexEntry, 0)
+			return false, nil
+		}
+	}
+
+	return len(ss.index)*IndexEntrySize == len(data), nil
+}
+
+func (ss *StreamState) headerMatches(entry IndexEntry) (bool, error) {
+	file, err := os.Open(ss.File)
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	if _, err := file.Seek(int64(entry.Offset), io.SeekStart); err != nil {
+		return false, err
+	}
+
+	header := RecordHeader{}
+	if err := binary.Read(file, binary.BigEndian, &header); err != nil {
+		return false, nil
+	}
+
+	return header.Record == entry.Record && header.Size == entry.Size, nil
+}
+
+// Scans any records after the last indexed one, indexing them and truncating
+// the file where the last record is incomplete.
+func (ss *StreamState) recoverTail(clean bool) error {
+	offset := uint64(0)
+	position := uint64(0)
+
+	if len(ss.index) > 0 {
+		last := ss.index[len(ss.index)-1]
+		offset = last.Offset + RecordHeaderSize + uint64(last.Size)
+		position = last.Position + uint64(last.Size)
+	}
+
+	file, err := os.OpenFile(ss.File, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	length := uint64(stat.Size())
+	indexed := len(ss.index)
+
+	if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+
+	for offset < length {
+		header := RecordHeader{}
+		if offset+RecordHeaderSize > length {
+			break
+		}
+		if err := binary.Read(file, binary.BigEndian, &header); err != nil {
+			return err
+		}
+		if offset+RecordHeaderSize+uint64(header.Size) > length {
+			break
+		}
+		// Gaps in the numbering are kept, records are looked up by number
+		// so they only have to be in order.
+		if len(ss.index) > 0 {
+			previous := ss.index[len(ss.index)-1].Record
+			if header.Record <= previous {
+				return fmt.Errorf("%s: record %d at %d follows record %d", ss.File, header.Record, offset, previous)
+			}
+			if header.Record != previous+1 {
+				log.Printf("%s: records %d to %d are missing", ss.File, previous+1, header.Record-1)
+			}
+		}
+
+		ss.index = append(ss.index, IndexEntry{
+			Record:   header.Record,
+			Offset:   offset,
+			Position: position,
+			Size:     header.Size,
+		})
+
+		if _, err := file.Seek(int64(header.Size), io.SeekCurrent); err != nil {
+			return err
+		}
+
+		offset += RecordHeaderSize + uint64(header.Size)
+		position += uint64(header.Size)
+	}
+
+	if offset < length {
+		log.Printf("%s: truncating partial record at %d (%d bytes)", ss.File, offset, length-offset)
+		if err := file.Truncate(int64(offset)); err != nil {
+			return err
+		}
+	}
+
+	ss.length = offset
+	ss.Size = position
+	ss.Record = 0
+	if len(ss.index) > 0 {
+		ss.Record = ss.index[len(ss.index)-1].Record + 1
+	}
+
+	if !clean || len(ss.index) != indexed || offset < length {
+		return ss.writeIndex()
+	}
+
+	return nil
+}
+
+func (ss *StreamState) writeIndex() error {
+	var buffer bytes.Buffer
+	for _, entry := range ss.index {
+		binary.Write(&buffer, binary.BigEndian, entry)
+	}
+
+	temporary := ss.IndexFile() + ".tmp"
+	if err := writeFileSynced(temporary, buffer.Bytes()); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, ss.IndexFile())
+}
+
+func (ss *StreamState) Append(body []byte, now time.Time) error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if err := ss.open(); err != nil {
+		return err
+	}
+
+	header := RecordHeader{
+		Size:   uint32(len(body)),
+		Record: ss.Record,
+	}
+
+	entry := IndexEntry{
+		Record:   ss.Record,
+		Offset:   ss.length,
+		Position: ss.Size,
+		Size:     header.Size,
+	}
+
+	var record bytes.Buffer
+	binary.Write(&record, binary.BigEndian, header)
+	record.Write(body)
+
+	// One write for the header and body keeps torn records to the tail.
+	if err := appendFile(ss.File, record.Bytes()); err != nil {
+		return err
+	}
+
+	var indexed bytes.Buffer
+	binary.Write(&indexed, binary.BigEndian, entry)
+
+	// The record is safely in the stream, a missing index entry will be
+	// recovered from the file when it's next opened.
+	if err := appendFile(ss.IndexFile(), indexed.Bytes()); err != nil {
+		log.Printf("Error: %v", err)
+	}
+
+	ss.index = append(ss.index, entry)
+	ss.length += uint64(record.Len())
+	ss.Record += 1
+	ss.Time = uint64(now.Unix())
+	ss.Size += uint64(len(body))
+
+	log.Printf("Append reading %v (%v bytes)", ss.Record, ss.Size)
+
+	return nil
+}
+
+// The append helpers read the device, so callers hold the device's lock.
+func (ss *StreamState) AppendConfiguration(device *FakeDevice) {
+	record := generateFakeConfiguration(device)
+	if bytes.Equal(record.Hash, ss.lastHash) {
+		return
+	}
+	body := proto.NewBuffer(make([]byte, 0))
+	body.EncodeMessage(record)
+	if err := ss.Append(body.Bytes(), device.Now()); err != nil {
+		log.Printf("Error: %v", err)
+		return
+	}
+	ss.lastHash = record.Hash
+}
+
+func (ss *StreamState) AppendReading(device *FakeDevice) {
+	ss.AppendReadingAt(device, device.Now())
+}
+
+func (ss *StreamState) AppendReadingAt(device *FakeDevice, now time.Time) {
+	meta := uint64(0)
+	if status := device.State.Streams[1].Status(); status.Record > 0 {
+		meta = status.Record - 1
+	}
+	record := generateFakeReading(device, uint32(ss.Status().Record), meta, now)
+	body := proto.NewBuffer(make([]byte, 0))
+	body.EncodeMessage(record)
+	if err := ss.Append(body.Bytes(), now); err != nil {
+		log.Printf("Error: %v", err)
+	}
+}
+
+// Reset removes the stream and its index, starting over from record zero.
+func (ss *StreamState) Reset() error {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	for _, name := range []string{ss.File, ss.IndexFile()} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	ss.opened = false
+	ss.index = make([]IndexEntry, 0)
+	ss.length = 0
+	ss.lastHash = nil
+	ss.Time = 0
+	ss.Size = 0
+	ss.Record = 0
+
+	log.Printf("Reset %s", ss.File)
+
+	return ss.open()
+}
+
+func (ss *StreamState) OpenFile() (*os.File, error) {
+	return os.OpenFile(ss.File, os.O_CREATE, 0644)
+}
+
+// Entries returns the index entries for records in [start, end).
+func (ss *StreamState) Entries(start, end uint64) []IndexEntry {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	first := sort.Search(len(ss.index), func(i int) bool {
+		return ss.index[i].Record >= start
+	})
+	last := sort.Search(len(ss.index), func(i int) bool {
+		return ss.index[i].Record >= end
+	})
+	if last < first {
+		return []IndexEntry{}
+	}
+	entries := make([]IndexEntry, last-first)
+	copy(entries, ss.index[first:last])
+	return entries
+}
+
+func appendFile(name string, data []byte) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("writing %s: %v", name, err)
+	}
+
+	return nil
+}
+
+func writeFileSynced(name string, data []byte) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func readFileIfExists(name string) ([]byte, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return []byte{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var buffer bytes.Buffer
+	if _, err := io.Copy(&buffer, file); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func statFileIfExists(name string) (uint64, error) {
+	stat, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Size()), nil
+}
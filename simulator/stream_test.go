@@ -0,0 +1,272 @@
+package simulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempDir(tb testing.TB) string {
+	dir, err := ioutil.TempDir("", "fk-simulator")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return dir
+}
+
+// writeRecords writes records with the given numbers straight to a stream
+// file, bypassing StreamState, with bodies of size bytes.
+func writeRecords(tb testing.TB, name string, records []uint64, size int) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	writer := bufio.NewWriter(file)
+	body := make([]byte, size)
+	for _, record := range records {
+		binary.Write(writer, binary.BigEndian, RecordHeader{Size: uint32(size), Record: record})
+		writer.Write(body)
+	}
+
+	if err := writer.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func numbered(first, count uint64) []uint64 {
+	records := make([]uint64, count)
+	for i := range records {
+		records[i] = first + uint64(i)
+	}
+	return records
+}
+
+func openStream(tb testing.TB, name string) *StreamState {
+	ss := &StreamState{File: name}
+	if err := ss.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	return ss
+}
+
+func appendRecords(tb testing.TB, ss *StreamState, count int) {
+	for i := 0; i < count; i += 1 {
+		if err := ss.Append([]byte(fmt.Sprintf("record %d", i)), time.Unix(0, 0)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func fileSize(tb testing.TB, name string) int64 {
+	stat, err := os.Stat(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return stat.Size()
+}
+
+func checkStream(t *testing.T, ss *StreamState, records []uint64) {
+	entries := ss.Entries(0, ^uint64(0))
+	if len(entries) != len(records) {
+		t.Fatalf("expected %d entries, got %d", len(records), len(entries))
+	}
+
+	offset, position := uint64(0), uint64(0)
+	for i, entry := range entries {
+		if entry.Record != records[i] || entry.Offset != offset || entry.Position != position {
+			t.Fatalf("entry %d is %+v, expected record %d at %d (%d)", i, entry, records[i], offset, position)
+		}
+		offset += RecordHeaderSize + uint64(entry.Size)
+		position += uint64(entry.Size)
+	}
+
+	if length := uint64(fileSize(t, ss.File)); length != offset {
+		t.Fatalf("expected %d bytes, file has %d", offset, length)
+	}
+	if ss.Size != position {
+		t.Fatalf("expected size %d, got %d", position, ss.Size)
+	}
+	if len(records) > 0 && ss.Record != records[len(records)-1]+1 {
+		t.Fatalf("expected next record %d, got %d", records[len(records)-1]+1, ss.Record)
+	}
+}
+
+func TestStreamRecoversTornTail(t *testing.T) {
+	torn := map[string][]byte{
+		"short header": []byte{0, 0, 0},
+		"short body":   []byte{0, 0, 0, 100, 0, 0, 0, 0, 0, 0, 0, 10, 1, 2, 3},
+	}
+
+	for name, tail := range torn {
+		t.Run(name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, "data.fkpb")
+			appendRecords(t, openStream(t, file), 10)
+
+			if err := appendFile(file, tail); err != nil {
+				t.Fatal(err)
+			}
+
+			ss := openStream(t, file)
+			checkStream(t, ss, numbered(0, 10))
+
+			appendRecords(t, ss, 1)
+			checkStream(t, openStream(t, file), numbered(0, 11))
+		})
+	}
+}
+
+func TestStreamKeepsRecordsAfterGap(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "data.fkpb")
+	records := []uint64{0, 1, 2, 5, 6}
+	writeRecords(t, file, records, 16)
+
+	ss := openStream(t, file)
+	checkStream(t, ss, records)
+
+	if entries := ss.Entries(3, 6); len(entries) != 1 || entries[0].Record != 5 {
+		t.Fatalf("expected record 5 alone, got %+v", entries)
+	}
+}
+
+func TestStreamRefusesRecordsOutOfOrder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "data.fkpb")
+	writeRecords(t, file, []uint64{0, 1, 2, 2, 3}, 16)
+	size := fileSize(t, file)
+
+	ss := &StreamState{File: file}
+	if err := ss.Open(); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if fileSize(t, file) != size {
+		t.Fatalf("file was truncated")
+	}
+}
+
+func TestStreamRebuildsIndex(t *testing.T) {
+	damage := map[string]func(t *testing.T, file string){
+		"missing": func(t *testing.T, file string) {
+			if err := os.Remove(file + ".idx"); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"partial": func(t *testing.T, file string) {
+			if err := os.Truncate(file+".idx", IndexEntrySize*4+IndexEntrySize/2); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"stale": func(t *testing.T, file string) {
+			// Replaced by a file of smaller records, the old index still
+			// fits inside it.
+			if err := os.Remove(file); err != nil {
+				t.Fatal(err)
+			}
+			writeRecords(t, file, numbered(0, 40), 4)
+		},
+		"corrupt": func(t *testing.T, file string) {
+			data, err := ioutil.ReadFile(file + ".idx")
+			if err != nil {
+				t.Fatal(err)
+			}
+			binary.BigEndian.PutUint64(data[IndexEntrySize*3+8:], 1)
+			if err := ioutil.WriteFile(file+".idx", data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+
+	for name, damaged := range damage {
+		t.Run(name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, "data.fkpb")
+			appendRecords(t, openStream(t, file), 10)
+
+			damaged(t, file)
+
+			ss := openStream(t, file)
+			records := numbered(0, 10)
+			if name == "stale" {
+				records = numbered(0, 40)
+			}
+			checkStream(t, ss, records)
+
+			if size := fileSize(t, file+".idx"); size != int64(len(records)*IndexEntrySize) {
+				t.Fatalf("expected the index to be rewritten, it's %d bytes", size)
+			}
+		})
+	}
+}
+
+const benchmarkRecords = 2000000
+
+var benchmarkStream struct {
+	once sync.Once
+	dir  string
+	file string
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if benchmarkStream.dir != "" {
+		os.RemoveAll(benchmarkStream.dir)
+	}
+	os.Exit(code)
+}
+
+// benchmarkFile is a stream of millions of records, with its index, shared
+// by the benchmarks.
+func benchmarkFile(b *testing.B) string {
+	benchmarkStream.once.Do(func() {
+		benchmarkStream.dir = tempDir(b)
+		benchmarkStream.file = filepath.Join(benchmarkStream.dir, "data.fkpb")
+		writeRecords(b, benchmarkStream.file, numbered(0, benchmarkRecords), 64)
+		openStream(b, benchmarkStream.file)
+	})
+	return benchmarkStream.file
+}
+
+func BenchmarkStreamOpen(b *testing.B) {
+	file := benchmarkFile(b)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += 1 {
+		ss := openStream(b, file)
+		if ss.Record != benchmarkRecords {
+			b.Fatalf("expected %d records, got %d", benchmarkRecords, ss.Record)
+		}
+	}
+}
+
+func BenchmarkStreamEntries(b *testing.B) {
+	ss := openStream(b, benchmarkFile(b))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += 1 {
+		start := uint64(i*7919) % benchmarkRecords
+		if entries := ss.Entries(start, start+1000); len(entries) == 0 {
+			b.Fatalf("no entries from %d", start)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Interfaces with these prefixes belong to containers, VMs and VPNs, which the
+// app is never on the other side of.
+var virtualInterfacePrefixes = []string{
+	"docker", "veth", "br-", "virbr", "vmnet", "vboxnet", "utun", "tun", "tap", "zt", "wg",
+}
+
+// AddressOptions chooses the addresses discovery is sent from. Loopback and
+// virtual interfaces are skipped unless Loopback is set or one is named by
+// Interface, and IPv6 allows IPv6 addresses.
+type AddressOptions struct {
+	Interface string
+	Loopback  bool
+	IPv6      bool
+}
+
+// InterfaceAddrs is an interface and its addresses, as net.Interfaces lists
+// them.
+type InterfaceAddrs struct {
+	Name  string
+	Flags net.Flags
+	Addrs []net.Addr
+}
+
+// LanAddress is an address on one of the machine's networks.
+type LanAddress struct {
+	Interface string
+	IP        net.IP
+	Net       *net.IPNet
+}
+
+func (la *LanAddress) IsIPv4() bool {
+	return la.IP.To4() != nil
+}
+
+// Broadcast is the subnet's broadcast address, IPv4 only.
+func (la *LanAddress) Broadcast() (net.IP, error) {
+	return lastAddr(la.Net)
+}
+
+func (la *LanAddress) String() string {
+	return fmt.Sprintf("%v (%v)", la.Net, la.Interface)
+}
+
+func isVirtualInterface(name string) bool {
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectAddresses picks the usable addresses from a list of interfaces, in
+// the order they're listed with IPv4 addresses first.
+func SelectAddresses(ifaces []InterfaceAddrs, o AddressOptions) []*LanAddress {
+	v4 := make([]*LanAddress, 0)
+	v6 := make([]*LanAddress, 0)
+
+	for _, iface := range ifaces {
+		if o.Interface != "" && iface.Name != o.Interface {
+			continue
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		allowed := o.Loopback || o.Interface != ""
+		if !allowed && (iface.Flags&net.FlagLoopback != 0 || isVirtualInterface(iface.Name)) {
+			continue
+		}
+
+		for _, addr := range iface.Addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipNet.IP.IsLoopback() && !allowed {
+				continue
+			}
+
+			la := &LanAddress{
+				Interface: iface.Name,
+				IP:        ipNet.IP,
+				Net:       ipNet,
+			}
+
+			if la.IsIPv4() {
+				v4 = append(v4, la)
+			} else if o.IPv6 && !ipNet.IP.IsLinkLocalUnicast() {
+				v6 = append(v6, la)
+			}
+		}
+	}
+
+	return append(v4, v6...)
+}
+
+// LanAddresses lists the machine's usable addresses.
+func LanAddresses(o AddressOptions) ([]*LanAddress, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]InterfaceAddrs, 0)
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, InterfaceAddrs{
+			Name:  i.Name,
+			Flags: i.Flags,
+			Addrs: addrs,
+		})
+	}
+
+	addresses := SelectAddresses(all, o)
+	if len(addresses) == 0 {
+		if o.Interface != "" {
+			return nil, fmt.Errorf("no usable addresses on %v", o.Interface)
+		}
+		return nil, errors.New("no usable addresses")
+	}
+
+	return addresses, nil
+}
+
+func lastAddr(n *net.IPNet) (net.IP, error) {
+	if n.IP.To4() == nil {
+		return net.IP{}, errors.New("IPv6 has no broadcast address")
+	}
+	mask := n.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(n.IP.To4())|^binary.BigEndian.Uint32(mask))
+	return ip, nil
+}
@@ -0,0 +1,160 @@
+package simulator
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func cidr(t *testing.T, s string) *net.IPNet {
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &net.IPNet{IP: ip, Mask: n.Mask}
+}
+
+func fakeInterfaces(t *testing.T) []InterfaceAddrs {
+	return []InterfaceAddrs{
+		{
+			Name:  "lo",
+			Flags: net.FlagUp | net.FlagLoopback,
+			Addrs: []net.Addr{cidr(t, "127.0.0.1/8"), cidr(t, "::1/128")},
+		},
+		{
+			Name:  "eth0",
+			Flags: net.FlagUp | net.FlagBroadcast,
+			Addrs: []net.Addr{cidr(t, "fe80::1/64"), cidr(t, "2001:db8::20/64"), cidr(t, "192.168.1.20/24")},
+		},
+		{
+			Name:  "docker0",
+			Flags: net.FlagUp | net.FlagBroadcast,
+			Addrs: []net.Addr{cidr(t, "172.17.0.1/16")},
+		},
+		{
+			Name:  "eth1",
+			Flags: net.FlagBroadcast,
+			Addrs: []net.Addr{cidr(t, "192.168.2.5/24")},
+		},
+		{
+			Name:  "wlan0",
+			Flags: net.FlagUp | net.FlagBroadcast,
+			Addrs: []net.Addr{&net.IPAddr{IP: net.ParseIP("10.0.9.9")}, cidr(t, "10.0.5.7/16"), cidr(t, "2001:db8:1::7/64")},
+		},
+	}
+}
+
+func TestSelectAddresses(t *testing.T) {
+	cases := []struct {
+		name     string
+		options  AddressOptions
+		expected []string
+	}{
+		{
+			name:     "defaults",
+			options:  AddressOptions{},
+			expected: []string{"eth0 192.168.1.20", "wlan0 10.0.5.7"},
+		},
+		{
+			name:     "ipv6 after ipv4 without link local",
+			options:  AddressOptions{IPv6: true},
+			expected: []string{"eth0 192.168.1.20", "wlan0 10.0.5.7", "eth0 2001:db8::20", "wlan0 2001:db8:1::7"},
+		},
+		{
+			name:     "loopback and virtual",
+			options:  AddressOptions{Loopback: true},
+			expected: []string{"lo 127.0.0.1", "eth0 192.168.1.20", "docker0 172.17.0.1", "wlan0 10.0.5.7"},
+		},
+		{
+			name:     "loopback with ipv6",
+			options:  AddressOptions{Loopback: true, IPv6: true},
+			expected: []string{"lo 127.0.0.1", "eth0 192.168.1.20", "docker0 172.17.0.1", "wlan0 10.0.5.7", "lo ::1", "eth0 2001:db8::20", "wlan0 2001:db8:1::7"},
+		},
+		{
+			name:     "named interface",
+			options:  AddressOptions{Interface: "wlan0"},
+			expected: []string{"wlan0 10.0.5.7"},
+		},
+		{
+			name:     "named virtual interface",
+			options:  AddressOptions{Interface: "docker0"},
+			expected: []string{"docker0 172.17.0.1"},
+		},
+		{
+			name:     "named loopback interface",
+			options:  AddressOptions{Interface: "lo"},
+			expected: []string{"lo 127.0.0.1"},
+		},
+		{
+			name:     "named interface that's down",
+			options:  AddressOptions{Interface: "eth1"},
+			expected: []string{},
+		},
+		{
+			name:     "named interface that's missing",
+			options:  AddressOptions{Interface: "eth9"},
+			expected: []string{},
+		},
+	}
+
+	ifaces := fakeInterfaces(t)
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual := make([]string, 0)
+			for _, la := range SelectAddresses(ifaces, c.options) {
+				actual = append(actual, fmt.Sprintf("%s %v", la.Interface, la.IP))
+			}
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestLastAddr(t *testing.T) {
+	cases := []struct {
+		name     string
+		net      *net.IPNet
+		expected string
+	}{
+		{
+			name:     "/24",
+			net:      cidr(t, "192.168.1.20/24"),
+			expected: "192.168.1.255",
+		},
+		{
+			name:     "/16",
+			net:      cidr(t, "10.0.5.7/16"),
+			expected: "10.0.255.255",
+		},
+		{
+			name:     "ipv6 length mask",
+			net:      &net.IPNet{IP: net.ParseIP("192.168.1.20"), Mask: net.CIDRMask(120, 128)},
+			expected: "192.168.1.255",
+		},
+		{
+			name: "ipv6",
+			net:  cidr(t, "2001:db8::20/64"),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ip, err := lastAddr(c.net)
+			if c.expected == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip.String() != c.expected {
+				t.Errorf("expected %s, got %v", c.expected, ip)
+			}
+		})
+	}
+}